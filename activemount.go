@@ -2,6 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
 )
 
 // activeMount is used to count the number of active mounts of a volume by a container.
@@ -19,3 +25,166 @@ func (am *activeMount) mustMarshal() []byte {
 	}
 	return payload
 }
+
+// readActiveMounts reads all the active mount files of the volume and returns their usage counts by mount ID.
+//
+// The caller is expected to hold the lock on the volume's activemounts/ directory. Errors are not logged.
+func (d *DockerOnTop) readActiveMounts(volumeName string) (map[string]int, error) {
+	entries, err := os.ReadDir(d.activemountsdir(volumeName))
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		payload, err := os.ReadFile(d.activemountsdir(volumeName) + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		var am activeMount
+		if err = json.Unmarshal(payload, &am); err != nil {
+			return nil, fmt.Errorf("failed to decode active mount file %s: %w", entry.Name(), err)
+		}
+		usages[entry.Name()] = am.UsageCount
+	}
+	return usages, nil
+}
+
+// lockIdleVolume takes the exclusive lock on the volume's activemounts/ directory (the same one that is taken by
+// `DockerOnTop.Mount` and `DockerOnTop.Unmount`) and checks that no container is using the volume and the overlay is
+// not mounted. This allows to safely perform operations that are not allowed while the volume is mounted (such as
+// modifying its upperdir).
+//
+// On success, the lock is returned, and it must be `.Close()`d by the caller when the operation is completed. If the
+// volume is in use, the lock is released and an error is returned. Errors are logged.
+func (d *DockerOnTop) lockIdleVolume(volumeName string) (*lockedFile, error) {
+	var activemountsdir lockedFile
+	err := activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return nil, err
+	}
+	if err = d.requireIdle(volumeName, &activemountsdir); err != nil {
+		// The error is already logged by `d.requireIdle`
+		return nil, err
+	}
+	return &activemountsdir, nil
+}
+
+// requireIdle is the check of `lockIdleVolume` for the already taken lock `activemountsdir`. If the volume is in use
+// or the check fails, the lock is released and an error is returned. Errors are logged.
+func (d *DockerOnTop) requireIdle(volumeName string, activemountsdir *lockedFile) error {
+	_, err := activemountsdir.ReadDir(1) // Check if there are any files inside activemounts dir
+	if errors.Is(err, io.EOF) {
+		// Normally, the overlay is unmounted when there are no active mounts, but it might be left mounted,
+		// e.g., if the plugin was terminated abruptly
+		mounted, err := d.volumeMounted(volumeName)
+		if err == nil && !mounted {
+			return nil
+		}
+
+		activemountsdir.Close() // There's nothing I can do about the error if it occurs
+		if err != nil {
+			log.Errorf("Failed to check if volume %s is mounted: %v", volumeName, err)
+			return internalError("failed to check if the volume is mounted", err)
+		}
+		log.Warningf("Volume %s is not in use but is still mounted", volumeName)
+		return fmt.Errorf("volume %s is not in use but is still mounted (`fsck -repair` can fix this)",
+			volumeName)
+	}
+
+	activemountsdir.Close() // There's nothing I can do about the error if it occurs
+	if err == nil {
+		log.Debugf("Volume %s is in use", volumeName)
+		return fmt.Errorf("volume %s is in use by a container", volumeName)
+	} else {
+		log.Errorf("Failed to list the activemounts directory: %v", err)
+		return internalError("failed to list activemounts/", err)
+	}
+}
+
+// lockIdleUpper is `lockIdleVolume` for the operations that replace the volume's upperdir: besides the volume itself,
+// the volumes stacked on it must not be in use either (see `lockIdleDependents`). On success, the returned function
+// must be called to release all the locks when the operation is completed. Errors are logged.
+func (d *DockerOnTop) lockIdleUpper(volumeName string) (func(), error) {
+	activemountsdir, err := d.lockIdleVolume(volumeName)
+	if err != nil {
+		// The error is already logged by `d.lockIdleVolume`
+		return nil, err
+	}
+	releaseDependents, err := d.lockIdleDependents(volumeName, d.upperdir(volumeName))
+	if err != nil {
+		activemountsdir.Close() // There's nothing I can do about the error if it occurs
+		// The error is already logged by `d.lockIdleDependents`
+		return nil, err
+	}
+	return func() {
+		releaseDependents()
+		activemountsdir.Close() // There's nothing I can do about the error if it occurs
+	}, nil
+}
+
+// lockIdleDependents takes the locks on activemounts/ of the volumes (other than `volumeName`) that have `layer` among
+// their lower layers (see `volumeLowerDirs`) and checks that none of them is in use, just like `lockIdleVolume`. This
+// is needed before modifying the layer: a mounted overlay must not have its lower layers modified. E.g., the layer is
+// the base directory of a volume that is committed, or the upperdir of a volume that is the base of other volumes.
+//
+// The locks are not waited for: if one is taken, the volume is considered to be in use. Otherwise, two such
+// operations on volumes that depend on each other's layers would deadlock.
+//
+// On success, the returned function must be called to release the locks when the operation is completed. Errors are
+// logged.
+func (d *DockerOnTop) lockIdleDependents(volumeName string, layer string) (func(), error) {
+	entries, err := os.ReadDir(d.dotRootDir)
+	if err != nil {
+		log.Errorf("Failed to list the volumes: %v", err)
+		return nil, internalError("failed to list the volumes", err)
+	}
+
+	var locks []*lockedFile
+	release := func() {
+		for _, lock := range locks {
+			lock.Close() // There's nothing I can do about the error if it occurs
+		}
+	}
+
+	layer = filepath.Clean(layer)
+	for _, entry := range entries {
+		dependent := entry.Name()
+		if dependent == volumeName || !d.volumeDependsOn(dependent, layer) {
+			continue
+		}
+
+		lock := &lockedFile{}
+		err = lock.TryOpen(d.activemountsdir(dependent))
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			log.Debugf("Volume %s, which depends on %s, is locked", dependent, layer)
+			err = fmt.Errorf("volume %s is busy", dependent)
+		} else if err == nil {
+			// The error is already logged by `d.requireIdle`
+			err = d.requireIdle(dependent, lock)
+		}
+		if err != nil {
+			// Otherwise, the error is already logged (and wrapped in `internalError`) in lockedFile.go
+			release()
+			return nil, fmt.Errorf("the change would affect volume %s: %w", dependent, err)
+		}
+		locks = append(locks, lock)
+	}
+	return release, nil
+}
+
+// volumeDependsOn tells if `layer` (a clean path) is among the volume's lower layers. Volumes with missing or corrupt
+// metadata are considered independent (as in `volumeChildren`).
+func (d *DockerOnTop) volumeDependsOn(volumeName string, layer string) bool {
+	lowers, err := d.volumeLowerDirs(volumeName)
+	if err != nil {
+		return false
+	}
+	for _, lower := range lowers {
+		if filepath.Clean(lower) == layer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminCommand is a subcommand of the docker-on-top executable, which allows to inspect and fix the volumes without
+// going through the docker daemon. Admin commands work with the dot root directory directly and take the same locks
+// as the daemon does, so they are safe to run while the daemon is running.
+type adminCommand struct {
+	// args is the arguments synopsis, for the help message
+	args string
+	// help is a one-line description of the command, for the help message
+	help string
+	// flags lists the boolean flags that the command accepts (before the positional arguments)
+	flags []string
+	// minArgs and maxArgs limit the number of positional arguments. Negative `maxArgs` means no limit
+	minArgs, maxArgs int
+	run              func(d *DockerOnTop, args []string, flags map[string]bool) error
+}
+
+var adminCommands = map[string]adminCommand{
+	"ls": {
+		args: "", help: "list the volumes",
+		minArgs: 0, maxArgs: 0, run: adminLs,
+	},
+	"inspect": {
+		args: "<volume>...", help: "show detailed information on the volumes as JSON",
+		minArgs: 1, maxArgs: -1, run: adminInspect,
+	},
+	"diff": {
+		args: "[-json] <volume>", help: "list the changes made to the volume (A: added, M: modified, D: deleted)",
+		flags: []string{"json"}, minArgs: 1, maxArgs: 1, run: adminDiff,
+	},
+	"commit": {
+		args: "[-dry-run] <volume>", help: "apply the changes made to the volume onto its base directory " +
+			"(it must not be in use) and list them",
+		flags: []string{"dry-run"}, minArgs: 1, maxArgs: 1, run: adminCommit,
+	},
+	"reset": {
+		args: "<volume> [<path>]", help: "discard the changes made to the volume or to a single path in it " +
+			"(it must not be in use)",
+		minArgs: 1, maxArgs: 2, run: adminReset,
+	},
+	"snapshot": {
+		args: "create|ls|restore|rm <volume> [<name>]", help: "manage the snapshots of the changes made to the " +
+			"volume (restoring requires that it is not in use)",
+		minArgs: 2, maxArgs: 3, run: adminSnapshot,
+	},
+	"history": {
+		args: "ls|restore <volume> [<generation>]", help: "list the saved states of a volume created with " +
+			"`-o history=N` or restore one (it must not be in use)",
+		minArgs: 2, maxArgs: 3, run: adminHistory,
+	},
+	"trash": {
+		args: "ls|restore <volume> [<generation>]", help: "list the discarded changes of a volatile volume created " +
+			"with `-o trash=N` or restore them (it must not be in use)",
+		minArgs: 2, maxArgs: 3, run: adminTrash,
+	},
+	"quota": {
+		args: "<volume> [<size> [<inodes>]]", help: "show the quota of the volume and its usage, or change the " +
+			"limits of a volume created with `-o quotamode=project`",
+		minArgs: 1, maxArgs: 3, run: adminQuota,
+	},
+	"fsck": {
+		args: "[-repair] [<volume>...]", help: "check the volumes (all, by default) for inconsistencies",
+		flags: []string{"repair"}, minArgs: 0, maxArgs: -1, run: adminFsck,
+	},
+}
+
+// adminUsage prints the list of admin commands.
+func adminUsage() {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, adminCommands[name].args, adminCommands[name].help)
+	}
+	_ = w.Flush()
+}
+
+// runAdminCommand runs the admin command specified by `args` (the command name followed by its arguments) against
+// the dot root directory from the config.
+func runAdminCommand(config Config, args []string) error {
+	name, args := args[0], args[1:]
+	command, ok := adminCommands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+
+	flags := make(map[string]bool)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag := strings.TrimLeft(args[0], "-")
+		if !containsString(command.flags, flag) {
+			return fmt.Errorf("unknown flag %s. Usage: docker-on-top %s %s", args[0], name, command.args)
+		}
+		flags[flag] = true
+		args = args[1:]
+	}
+	if len(args) < command.minArgs || (command.maxArgs >= 0 && len(args) > command.maxArgs) {
+		return fmt.Errorf("wrong number of arguments. Usage: docker-on-top %s %s", name, command.args)
+	}
+
+	d, err := OpenDockerOnTop(config.DotRootDir)
+	if err != nil {
+		return err
+	}
+	return command.run(d, args, flags)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// requireVolume checks that the volume exists.
+func requireVolume(d *DockerOnTop, volumeName string) error {
+	if !volNameFormat.MatchString(volumeName) {
+		return errors.New("invalid volume name " + volumeName)
+	}
+	_, err := os.Stat(d.dotRootDir + volumeName)
+	if os.IsNotExist(err) {
+		return errors.New("no such volume " + volumeName)
+	}
+	return err
+}
+
+func adminLs(d *DockerOnTop, _ []string, _ map[string]bool) error {
+	response, err := d.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBASE\tVOLATILE\tMOUNTED\tACTIVE MOUNTS\tUPPER SIZE")
+	for _, vol := range response.Volumes {
+		if vol.Status == nil {
+			// Failed to get the status (the error is logged by `d.List`)
+			fmt.Fprintf(w, "%s\t?\t?\t?\t?\t?\n", vol.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%d\t%v\n", vol.Name, vol.Status["Base"], vol.Status["Volatile"],
+			vol.Status["Mounted"], len(vol.Status["ActiveMounts"].(map[string]int)), vol.Status["UpperSize"])
+	}
+	return w.Flush()
+}
+
+func adminInspect(d *DockerOnTop, args []string, _ map[string]bool) error {
+	var volumes []interface{}
+	for _, volumeName := range args {
+		if err := requireVolume(d, volumeName); err != nil {
+			return err
+		}
+		vol, err := d.volumeStatus(volumeName)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, vol)
+	}
+
+	payload, err := json.MarshalIndent(volumes, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(payload))
+	return nil
+}
+
+func adminDiff(d *DockerOnTop, args []string, flags map[string]bool) error {
+	volumeName := args[0]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	changes, err := d.volumeDiff(volumeName)
+	if err != nil {
+		return err
+	}
+
+	return printChanges(changes, flags["json"])
+}
+
+// printChanges prints the changes as listed by `diffUpper`: either as JSON or as a line per change.
+func printChanges(changes []volumeChange, asJSON bool) error {
+	if asJSON {
+		if changes == nil {
+			changes = []volumeChange{}
+		}
+		payload, err := json.MarshalIndent(changes, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(payload))
+		return nil
+	}
+
+	for _, change := range changes {
+		line := strings.ToUpper(change.Kind[:1]) + " " + change.Path
+		if change.RenamedFrom != "" {
+			line += " (renamed from " + change.RenamedFrom + ")"
+		}
+		if change.Opaque {
+			line += " (replaces the base directory)"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func adminCommit(d *DockerOnTop, args []string, flags map[string]bool) error {
+	volumeName := args[0]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	changes, err := d.volumeCommit(volumeName, flags["dry-run"])
+	if err != nil {
+		return err
+	}
+	return printChanges(changes, false)
+}
+
+func adminReset(d *DockerOnTop, args []string, _ map[string]bool) error {
+	volumeName := args[0]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	relPath := "/"
+	if len(args) > 1 {
+		// The path is relative to the volume's root, regardless of whether it starts with a slash
+		relPath = filepath.Clean("/" + args[1])
+	}
+
+	release, err := d.lockIdleUpper(volumeName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// A pending history generation is saved before the changes are discarded. The errors are logged by
+	// `d.historyCatchUp`, and the history is not worth failing the reset for
+	_ = d.historyCatchUp(volumeName)
+
+	if relPath == "/" {
+		return d.volumeTreeResetUpper(volumeName)
+	}
+	return d.volumeTreeResetPath(volumeName, relPath)
+}
+
+func adminSnapshot(d *DockerOnTop, args []string, _ map[string]bool) error {
+	action, volumeName := args[0], args[1]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	if action == "ls" {
+		if len(args) != 2 {
+			return errors.New("wrong number of arguments. Usage: docker-on-top snapshot ls <volume>")
+		}
+		snapshots, err := d.snapshotList(volumeName)
+		if err != nil {
+			return err
+		}
+		return printSavedUppers(snapshots, "NAME")
+	}
+
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments. Usage: docker-on-top snapshot %s <volume> <name>", action)
+	}
+	snapshotName := args[2]
+	switch action {
+	case "create":
+		_, err := d.snapshotCreate(volumeName, snapshotName)
+		return err
+	case "restore":
+		return d.snapshotRestore(volumeName, snapshotName)
+	case "rm":
+		return d.snapshotDelete(volumeName, snapshotName)
+	default:
+		return fmt.Errorf("unknown snapshot action %s: should be one of create, ls, restore, rm", action)
+	}
+}
+
+func adminHistory(d *DockerOnTop, args []string, _ map[string]bool) error {
+	action, volumeName := args[0], args[1]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	switch {
+	case action == "ls" && len(args) == 2:
+		generations, err := d.historyList(volumeName)
+		if err != nil {
+			return err
+		}
+		return printSavedUppers(generations, "GENERATION")
+	case action == "restore" && len(args) == 3:
+		return d.historyRestore(volumeName, args[2])
+	case action == "ls" || action == "restore":
+		return fmt.Errorf("wrong number of arguments. Usage: docker-on-top history %s",
+			"ls <volume> | restore <volume> <generation>")
+	default:
+		return fmt.Errorf("unknown history action %s: should be one of ls, restore", action)
+	}
+}
+
+func adminTrash(d *DockerOnTop, args []string, _ map[string]bool) error {
+	action, volumeName := args[0], args[1]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	switch {
+	case action == "ls" && len(args) == 2:
+		generations, err := d.trashList(volumeName)
+		if err != nil {
+			return err
+		}
+		return printSavedUppers(generations, "GENERATION")
+	case action == "restore" && len(args) == 3:
+		return d.trashRestore(volumeName, args[2])
+	case action == "ls" || action == "restore":
+		return fmt.Errorf("wrong number of arguments. Usage: docker-on-top trash %s",
+			"ls <volume> | restore <volume> <generation>")
+	default:
+		return fmt.Errorf("unknown trash action %s: should be one of ls, restore", action)
+	}
+}
+
+func adminQuota(d *DockerOnTop, args []string, _ map[string]bool) error {
+	volumeName := args[0]
+	if err := requireVolume(d, volumeName); err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		bytes, err := parseByteSize(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid size %s: %v", args[1], err)
+		}
+		var inodes uint64
+		if len(args) > 2 {
+			if inodes, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+				return fmt.Errorf("invalid number of inodes %s: should be a non-negative integer", args[2])
+			}
+		}
+		return d.projectQuotaUpdate(volumeName, bytes, inodes)
+	}
+
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	} else if vol.Quota == 0 {
+		return fmt.Errorf("volume %s has no quota", volumeName)
+	}
+	mode, used, inodes, inodesUsed := quotaModeImage, int64(0), "-", "-"
+	if vol.QuotaMode == quotaModeProject {
+		var n uint64
+		mode = quotaModeProject
+		used, n, err = d.projectQuotaUsage(volumeName, vol.ProjectID)
+		inodesUsed = strconv.FormatUint(n, 10)
+		if vol.QuotaInodes > 0 {
+			inodes = strconv.FormatUint(vol.QuotaInodes, 10)
+		}
+	} else {
+		used, _, err = d.quotaUsage(volumeName)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "MODE\tQUOTA\tUSED\tINODES\tINODES USED\n")
+	fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", mode, vol.Quota, used, inodes, inodesUsed)
+	return w.Flush()
+}
+
+// printSavedUppers prints the snapshots, history or trash generations as a table. `nameHeader` is the header of the
+// first column.
+func printSavedUppers(saved []snapshotInfo, nameHeader string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tCREATED\tSIZE\n", nameHeader)
+	for _, info := range saved {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", info.Name, info.CreatedAt.Format(time.RFC3339), info.Size)
+	}
+	return w.Flush()
+}
+
+func adminFsck(d *DockerOnTop, args []string, flags map[string]bool) error {
+	repair := flags["repair"]
+
+	explicit := len(args) > 0
+	if !explicit {
+		entries, err := os.ReadDir(d.dotRootDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			args = append(args, entry.Name())
+		}
+	}
+
+	unrepaired := 0
+	for _, volumeName := range args {
+		if err := requireVolume(d, volumeName); err != nil {
+			// When checking all the volumes, it's, e.g., lost+found, if the dot root directory is a filesystem root
+			fmt.Printf("%s: skipped: %v\n", volumeName, err)
+			if explicit {
+				unrepaired++
+			}
+			continue
+		}
+		issues, err := d.fsckVolume(volumeName, repair)
+		if err != nil {
+			fmt.Printf("%s: failed to check: %v\n", volumeName, err)
+			unrepaired++
+			continue
+		}
+		for _, issue := range issues {
+			if issue.Repaired {
+				fmt.Printf("%s: %s (repaired)\n", volumeName, issue.Problem)
+			} else {
+				fmt.Printf("%s: %s\n", volumeName, issue.Problem)
+				unrepaired++
+			}
+		}
+	}
+
+	if unrepaired > 0 {
+		return fmt.Errorf("%d problem(s) found", unrepaired)
+	}
+	return nil
+}
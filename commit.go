@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// volumeCommit applies the changes made to the volume (see `volumeDiff`) onto its base directory and then discards
+// them from the upperdir, so that the volume looks the same as before, but the changes are now in the base.
+//
+// The volume must not be in use: the base directory must not be modified while the volume is mounted (see the
+// README). The same goes for the other volumes based on the same directory (see `lockIdleDependents`). The locks on
+// their activemounts/ are held for the whole operation, so none of them can be mounted in the process.
+//
+// If `dryRun` is set, the changes are only listed but not applied. Otherwise, the returned changes are the ones that
+// have been applied. If an error occurs, the base directory may be left with some of the changes applied, but the
+// upperdir is left intact, so the commit can be retried.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) volumeCommit(volumeName string, dryRun bool) ([]volumeChange, error) {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return nil, internalError("failed to retrieve the volume's metadata", err)
+	}
+	if vol.BaseVolume != "" {
+		log.Debugf("Volume %s is based on another volume. Cannot commit", volumeName)
+		return nil, errors.New("commit is not supported for volumes based on another volume")
+	} else if len(vol.BaseDirPaths) != 1 {
+		// The deletions of files that come from the lower bases cannot be applied to the topmost one
+		log.Debugf("Volume %s has %d base directories. Cannot commit", volumeName, len(vol.BaseDirPaths))
+		return nil, errors.New("commit is only supported for volumes with a single base directory")
+	}
+
+	activemountsdir, err := d.lockIdleVolume(volumeName)
+	if err != nil {
+		// The error is already logged by `d.lockIdleVolume`
+		return nil, err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	// Committing would change what the volumes based on this one see (the lock on activemounts/ ensures no such
+	// volumes are created in the process, see `DockerOnTop.Create`)
+	children, err := d.volumeChildren(volumeName)
+	if err != nil {
+		log.Errorf("Failed to list the volumes based on %s: %v", volumeName, err)
+		return nil, internalError("failed to check if other volumes are based on the volume", err)
+	} else if len(children) > 0 && !dryRun {
+		log.Debugf("Volume %s is the base of %v. Cannot commit", volumeName, children)
+		return nil, fmt.Errorf("the volume is the base volume of %s, so it cannot be committed",
+			strings.Join(children, ", "))
+	}
+
+	base := strings.TrimSuffix(vol.BaseDirPaths[0], "/")
+	if !dryRun {
+		release, err := d.lockIdleDependents(volumeName, base)
+		if err != nil {
+			// The error is already logged by `d.lockIdleDependents`
+			return nil, err
+		}
+		defer release()
+	}
+
+	prefix := overlayXattrPrefix(vol.OverlayOptions)
+	changes, err := diffUpper(strings.TrimSuffix(d.upperdir(volumeName), "/"), []string{base}, prefix)
+	if err != nil {
+		log.Errorf("Failed to compare the upperdir of %s to its base: %v", volumeName, err)
+		return nil, internalError("failed to list the changes", err)
+	}
+	if dryRun {
+		return changes, nil
+	}
+
+	// The changes are about to be moved out of the upperdir, so the pending history generation must be saved first.
+	// The errors are logged by `d.historyCatchUp`, and the history is not worth failing the commit for
+	_ = d.historyCatchUp(volumeName)
+
+	if err = applyChanges(base, d.commitstagingdir(volumeName), changes, prefix); err != nil {
+		log.Errorf("Failed to apply changes of %s to its base directory: %v", volumeName, err)
+		return nil, internalError("failed to apply the changes to the base directory", err)
+	}
+	log.Infof("Committed %d changes of volume %s to %s", len(changes), volumeName, base)
+
+	// The error is already logged and wrapped in `internalError` by `d.volumeTreeResetUpper`
+	return changes, d.volumeTreeResetUpper(volumeName)
+}
+
+// commitstagingdir is where `applyChanges` sets the data aside. It is outside the base directory, so that nothing
+// is left in the base if the plugin crashes in the process.
+func (d *DockerOnTop) commitstagingdir(volumeName string) string {
+	return d.storagedir(volumeName) + "commit"
+}
+
+// applyChanges applies the changes listed by `diffUpper` onto the directory `base`, which must be the (only) lower
+// layer that the changes were computed against. `staging` is a directory to set data aside in, which is created and
+// removed by the function (a leftover from an interrupted attempt is removed first). `prefix` is the
+// `overlayXattrPrefix` of the overlay: the overlay xattrs are not copied to the base.
+func applyChanges(base string, staging string, changes []volumeChange, prefix string) (err error) {
+	// The data of metacopy files is in the base, and it might be deleted or overwritten by the other changes (e.g.,
+	// if the file is renamed), so it is set aside before anything is modified
+	if err = os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err = os.Mkdir(staging, 0o700); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, os.RemoveAll(staging))
+	}()
+
+	staged := make(map[int]string)
+	for i, change := range changes {
+		if change.Kind == changeDeleted || !change.info.Mode().IsRegular() {
+			continue
+		}
+		metacopy, err := getOverlayXattr(change.upperPath, change.info, prefix, "metacopy")
+		if err != nil {
+			return err
+		}
+		if metacopy != nil {
+			staged[i] = filepath.Join(staging, strconv.Itoa(i))
+			if err = copyMetacopyData(base, change, staged[i], prefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Renamed directories take their contents from the base, so the contents must be copied before anything in the
+	// base is modified (the original location is deleted as a separate change). Parents come before children, so
+	// a directory renamed inside a renamed directory is copied to the already copied parent.
+	for _, change := range changes {
+		if change.RenamedFrom != "" && !change.Opaque {
+			if err = os.RemoveAll(base + change.Path); err != nil {
+				return err
+			}
+			if err = copyTree(base+change.RenamedFrom, base+change.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The directories' timestamps are set when their contents are already modified
+	var dirs []volumeChange
+
+	for i, change := range changes {
+		target := base + change.Path
+
+		if change.Kind == changeDeleted {
+			if err = os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if change.info.IsDir() {
+			if err = applyDirChange(target, change, prefix); err != nil {
+				return err
+			}
+			dirs = append(dirs, change)
+			continue
+		}
+
+		if err = applyFileChange(target, change, staged[i], prefix); err != nil {
+			return err
+		}
+		if err = copyTimes(target, change.info); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = copyTimes(base+dirs[i].Path, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDirChange makes `target` a directory with the attributes of the changed one. An opaque directory replaces
+// the existing one, a non-opaque one is merged with it. `prefix` is as in `applyChanges`.
+func applyDirChange(target string, change volumeChange, prefix string) error {
+	info, err := os.Lstat(target)
+	if err == nil && (change.Opaque || !info.IsDir()) {
+		if err = os.RemoveAll(target); err != nil {
+			return err
+		}
+		err = os.ErrNotExist
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		if err = os.Mkdir(target, 0o700); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return copyAttributes(change.upperPath, target, change.info, prefix)
+}
+
+// applyFileChange replaces `target` with a copy of the changed non-directory file. The new file is prepared aside
+// and then renamed over the target, so that the target is never left partially written. A temporary file left in the
+// target's directory by an interrupted attempt is removed by the retry.
+//
+// For a metacopy file, `staged` is the copy of its data (see `applyChanges`), otherwise it is empty. `prefix` is as in
+// `applyChanges`.
+func applyFileChange(target string, change volumeChange, staged string, prefix string) error {
+	tmp := filepath.Join(filepath.Dir(target), ".docker-on-top-commit."+filepath.Base(target))
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	var err error
+	if staged != "" {
+		// The staging directory may be on another filesystem than the base
+		if err = os.Rename(staged, tmp); errors.Is(err, syscall.EXDEV) {
+			err = copyFileData(staged, tmp)
+		}
+		if err == nil {
+			err = copyAttributes(change.upperPath, tmp, change.info, prefix)
+		}
+	} else {
+		err = copyEntry(change.upperPath, tmp, change.info, prefix)
+	}
+
+	if err == nil {
+		err = os.RemoveAll(target) // In case it's a directory, which would make the rename fail
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+	}
+	return err
+}
+
+// copyMetacopyData copies the data of a metacopy file from the base to a new file `dst`. `prefix` is as in
+// `applyChanges`.
+func copyMetacopyData(base string, change volumeChange, dst string, prefix string) error {
+	dataPath := change.lowerPath
+	redirect, err := getOverlayXattr(change.upperPath, change.info, prefix, "redirect")
+	if err != nil {
+		return err
+	}
+	if redirect != nil {
+		// A metacopy file that has been renamed takes the data from the original location
+		if !strings.HasPrefix(string(redirect), "/") {
+			return errors.New("unexpected relative redirect of metacopy file " + change.Path)
+		}
+		dataPath = base + string(redirect)
+	}
+	if dataPath == "" {
+		return &fs.PathError{Op: "find metacopy data", Path: change.Path, Err: fs.ErrNotExist}
+	}
+	return copyFileData(dataPath, dst)
+}
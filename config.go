@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// Config contains the settings of the docker-on-top daemon.
+//
+// The settings are taken from the defaults (see `defaultConfig`), then overridden by the config file, if one is
+// specified, then overridden by the command-line flags that are explicitly set.
+type Config struct {
+	// DotRootDir is the base directory of docker-on-top, where all the internal information is stored
+	DotRootDir string
+	// SocketPath is the path to the unix socket to serve at. If empty, the socket is created in docker's plugin
+	// discovery directory and named after `DriverName`
+	SocketPath string
+	// DriverName is the name of the volume driver, as it is specified in `docker volume create --driver`
+	DriverName string
+	// SocketGroup is the name or the numeric ID of the group that owns the socket
+	SocketGroup string
+	// LogLevel is one of: critical, error, warning, notice, info, debug
+	LogLevel string
+	// LogFormat is one of: color, plain, json
+	LogFormat string
+	// Pools maps the names of storage pools to directories where the volumes created with the `pool` option keep
+	// their changes (see `DockerOnTop.storagedir`). Only settable in the config file
+	Pools map[string]string `json:",omitempty"`
+	// DefaultPool is the pool for the volumes created without the `pool` option. If empty, such volumes keep their
+	// changes in the dot root directory. Only settable in the config file
+	DefaultPool string `json:",omitempty"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DotRootDir:  "/var/lib/docker-on-top/",
+		DriverName:  "docker-on-top",
+		SocketGroup: "0",
+		LogLevel:    "debug",
+		LogFormat:   "color",
+	}
+}
+
+// socketPath returns the path to the socket the daemon should serve at.
+func (c *Config) socketPath() string {
+	if c.SocketPath != "" {
+		return c.SocketPath
+	}
+	return "/run/docker/plugins/" + c.DriverName + ".sock"
+}
+
+// socketGid resolves `SocketGroup` to a numeric group ID.
+func (c *Config) socketGid() (int, error) {
+	if gid, err := strconv.Atoi(c.SocketGroup); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(c.SocketGroup)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// loadConfigFile overrides the settings in `c` with the ones specified in the JSON config file at `path`. The settings
+// that are absent from the file are left unchanged. Unknown settings are reported as an error.
+func (c *Config) loadConfigFile(path string) error {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseConfig builds the daemon config from the command-line arguments (without the program name) and the config
+// file that they refer to, if any. The non-flag arguments (that is, an admin command with its arguments, if any) are
+// returned as well.
+//
+// For admin commands, the log level defaults to "warning" instead of the configured one, unless set with a flag.
+func parseConfig(args []string) (Config, []string, error) {
+	config := defaultConfig()
+
+	// The flags' default values are only used for the help message: a flag only takes effect if it's explicitly set
+	flags := flag.NewFlagSet("docker-on-top", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON config file (see the README for the format)")
+	dotRootDir := flags.String("root", config.DotRootDir, "the dot root directory, where the volumes are stored")
+	socketPath := flags.String("socket", "", "path to the unix socket to serve at "+
+		"(default: /run/docker/plugins/<driver name>.sock)")
+	driverName := flags.String("name", config.DriverName, "the name of the volume driver")
+	socketGroup := flags.String("group", config.SocketGroup, "the group (name or gid) to own the socket")
+	logLevel := flags.String("log-level", config.LogLevel,
+		"log level: critical, error, warning, notice, info, or debug")
+	logFormat := flags.String("log-format", config.LogFormat, "log format: color, plain, or json")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-on-top [flags]              (run the daemon)")
+		fmt.Fprintln(os.Stderr, "       docker-on-top [flags] command ...  (run an admin command)")
+		fmt.Fprintln(os.Stderr, "\nCommands:")
+		adminUsage()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return config, nil, err
+	}
+
+	if *configFile != "" {
+		if err := config.loadConfigFile(*configFile); err != nil {
+			return config, nil, err
+		}
+	}
+	if flags.NArg() > 0 {
+		config.LogLevel = "warning"
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "root":
+			config.DotRootDir = *dotRootDir
+		case "socket":
+			config.SocketPath = *socketPath
+		case "name":
+			config.DriverName = *driverName
+		case "group":
+			config.SocketGroup = *socketGroup
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		}
+	})
+
+	if config.DotRootDir == "" {
+		return config, nil, errors.New("the dot root directory cannot be empty")
+	}
+	if !volNameFormat.MatchString(config.DriverName) {
+		return config, nil, errors.New("the driver name contains illegal characters: " +
+			"it should comply to \"[a-zA-Z0-9][a-zA-Z0-9_.-]*\"")
+	}
+	for name, dir := range config.Pools {
+		if !volNameFormat.MatchString(name) {
+			return config, nil, fmt.Errorf("the name of pool %s contains illegal characters: "+
+				"it should comply to \"[a-zA-Z0-9][a-zA-Z0-9_.-]*\"", name)
+		} else if !filepath.IsAbs(dir) {
+			return config, nil, fmt.Errorf("the directory of pool %s must be an absolute path", name)
+		}
+	}
+	if _, ok := config.Pools[config.DefaultPool]; config.DefaultPool != "" && !ok {
+		return config, nil, fmt.Errorf("the default pool %s is not defined in `Pools`", config.DefaultPool)
+	}
+
+	return config, flags.Args(), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+)
+
+// volumeChange is a change made to a volume, as compared to its base.
+type volumeChange struct {
+	// Path is the path of the changed file, relative to the volume's root (starting with a slash)
+	Path string
+	// Kind is one of `changeAdded`, `changeModified`, `changeDeleted`
+	Kind string
+	// Opaque is set for a directory that replaces the base directory at the same path (instead of being merged with it)
+	Opaque bool `json:",omitempty"`
+	// RenamedFrom is set for a directory that has been renamed (moved) from the given path
+	RenamedFrom string `json:",omitempty"`
+
+	// Mode, Size, and ModTime describe the changed file. They are not set for deleted files
+	Mode    string `json:",omitempty"`
+	Size    int64  `json:",omitempty"`
+	ModTime string `json:",omitempty"`
+
+	// upperPath is the path to the file in the upperdir
+	upperPath string
+	// info is the `os.Lstat` of `upperPath`
+	info fs.FileInfo
+	// lowerPath is the path to the file in the lower layers that is shadowed by this file (taking renames into
+	// account), or an empty string if the file does not exist in the lower layers
+	lowerPath string
+}
+
+// diffUpper compares the upperdir of an overlay (`upperdir`, with no trailing slash) to the overlay's lower layers
+// (`lowers`, the topmost first, no trailing slashes) and lists the changes, ordered such that parent directories
+// come before their contents.
+//
+// Directories that only exist in the upperdir as parents of the changed files are not reported. `prefix` is the
+// `overlayXattrPrefix` of the overlay.
+//
+// The overlay may be either mounted or not, but it must not be modified in the process.
+func diffUpper(upperdir string, lowers []string, prefix string) ([]volumeChange, error) {
+	var changes []volumeChange
+	err := diffUpperDir(upperdir, "/", "/", true, lowers, prefix, &changes)
+	return changes, err
+}
+
+// diffUpperDir appends the changes inside the upper directory `relDir` to `changes`. `lowerDir` is the path in
+// the lower layers which the directory is merged with (it is different from `relDir` if the directory or its
+// ancestor is renamed). If `lowerVisible` is false, the directory hides the lower layers (it is opaque).
+func diffUpperDir(upperdir string, relDir string, lowerDir string, lowerVisible bool, lowers []string, prefix string,
+	changes *[]volumeChange) error {
+
+	entries, err := os.ReadDir(upperdir + relDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		change := volumeChange{Path: relDir + entry.Name(), upperPath: upperdir + relDir + entry.Name()}
+		change.info, err = os.Lstat(change.upperPath)
+		if err != nil {
+			return err
+		}
+
+		var lowerInfo fs.FileInfo
+		lowerPath := lowerDir + entry.Name()
+		if lowerVisible {
+			change.lowerPath, lowerInfo, err = lowerLookup(lowers, lowerPath, prefix)
+			if err != nil {
+				return err
+			}
+		}
+
+		if isWhiteout(change.info) {
+			if lowerInfo != nil {
+				change.Kind = changeDeleted
+				*changes = append(*changes, change)
+			}
+			// Otherwise, this is a whiteout of something that is deleted from the base already
+			continue
+		}
+
+		change.Mode = change.info.Mode().String()
+		change.Size = change.info.Size()
+		change.ModTime = change.info.ModTime().Format(time.RFC3339Nano)
+
+		if lowerInfo == nil {
+			change.Kind = changeAdded
+		} else {
+			change.Kind = changeModified
+		}
+
+		if !change.info.IsDir() {
+			*changes = append(*changes, change)
+			continue
+		}
+
+		change.Opaque, err = isOpaqueDir(change.upperPath, change.info, prefix)
+		if err != nil {
+			return err
+		}
+		redirect, err := getOverlayXattr(change.upperPath, change.info, prefix, "redirect")
+		if err != nil {
+			return err
+		}
+
+		childLowerDir, childLowerVisible := lowerPath+"/", lowerVisible && !change.Opaque
+		if redirect != nil {
+			// An absolute redirect is relative to the overlay root, a relative one is relative to the parent
+			change.RenamedFrom = string(redirect)
+			if !strings.HasPrefix(change.RenamedFrom, "/") {
+				change.RenamedFrom = lowerDir + change.RenamedFrom
+			}
+			childLowerDir, childLowerVisible = change.RenamedFrom+"/", !change.Opaque
+		}
+
+		if change.Kind == changeAdded || change.Opaque || redirect != nil || !lowerInfo.IsDir() ||
+			ownershipOrModeDiffer(change.info, lowerInfo) {
+			*changes = append(*changes, change)
+		}
+
+		err = diffUpperDir(upperdir, change.Path+"/", childLowerDir, childLowerVisible, lowers, prefix, changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownershipOrModeDiffer tells whether the two files have different owner, group, or mode.
+func ownershipOrModeDiffer(a fs.FileInfo, b fs.FileInfo) bool {
+	statA, okA := a.Sys().(*syscall.Stat_t)
+	statB, okB := b.Sys().(*syscall.Stat_t)
+	if !okA || !okB {
+		return a.Mode() != b.Mode()
+	}
+	return statA.Mode != statB.Mode || statA.Uid != statB.Uid || statA.Gid != statB.Gid
+}
+
+// lowerLayers converts the lower layers of a volume (see `DockerOnTop.volumeLowerDirs`) to the form expected by
+// `diffUpper`.
+func lowerLayers(lowerDirs []string) []string {
+	lowers := make([]string, len(lowerDirs))
+	for i, lowerDir := range lowerDirs {
+		lowers[i] = strings.TrimSuffix(lowerDir, "/")
+	}
+	return lowers
+}
+
+// volumeDiff lists the changes made to the volume, as compared to its base (see `diffUpper`).
+//
+// The volume may be either mounted or not. The same lock as in `DockerOnTop.Mount` is held while the changes are
+// listed, so that the volume is not being mounted or unmounted in the process.
+//
+// Errors are logged and wrapped with `internalError`.
+func (d *DockerOnTop) volumeDiff(volumeName string) ([]volumeChange, error) {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return nil, internalError("failed to retrieve the volume's metadata", err)
+	}
+	lowers, err := d.volumeLowerDirs(volumeName)
+	if err != nil {
+		log.Errorf("Failed to resolve the lower layers of volume %s: %v", volumeName, err)
+		return nil, internalError("failed to resolve the volume's base", err)
+	}
+
+	var activemountsdir lockedFile
+	err = activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return nil, err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	changes, err := diffUpper(strings.TrimSuffix(d.currentUpperdir(volumeName), "/"), lowerLayers(lowers),
+		overlayXattrPrefix(vol.OverlayOptions))
+	if err != nil {
+		log.Errorf("Failed to compare the upperdir of %s to its base: %v", volumeName, err)
+		return nil, internalError("failed to list the changes", err)
+	}
+	return changes, nil
+}
@@ -18,17 +18,23 @@ func internalError(help string, err error) error {
 // DockerOnTop contains internal data of the docker-on-top volume driver and implements the `volume.Driver` interface
 // (from docker's go-plugins-helpers).
 //
-// **MUST BE** created with `NewDockerOnTop` only.
+// **MUST BE** created with `NewDockerOnTop` (or, for admin commands, `OpenDockerOnTop`) only.
 type DockerOnTop struct {
 	// dotRootDir is the base directory of docker-on-top, where all the internal information is stored.
-	// Must contain a trailing slash (ensured by `NewDockerOnTop`).
+	// Must contain a trailing slash (ensured by `NewDockerOnTop` and `OpenDockerOnTop`).
 	dotRootDir string
+	// pools maps the names of the storage pools to their directories (see `storagedir`), each with a trailing slash.
+	// Only needed to create volumes, so it is empty for admin commands
+	pools map[string]string
+	// defaultPool is the pool for the volumes created without the `pool` option, empty for none
+	defaultPool string
 }
 
 // NewDockerOnTop creates a new `DockerOnTop` object using the given directory as the dot root directory. If it doesn't
-// exist, it is created recursively (as if with `mkdir -p`). If an error occurs, it is returned and `DockerOnTop`
-// is not created.
-func NewDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
+// exist, it is created recursively (as if with `mkdir -p`). New volumes can be put to the storage `pools` (see
+// `Config.Pools`), `defaultPool` being the pool for the volumes that don't specify one (empty for none). If an error
+// occurs, it is returned and `DockerOnTop` is not created.
+func NewDockerOnTop(dotRootDir string, pools map[string]string, defaultPool string) (*DockerOnTop, error) {
 	if len(dotRootDir) == 0 {
 		return nil, errors.New("`dotRootDir` cannot be empty")
 	}
@@ -42,7 +48,13 @@ func NewDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
 		return nil, err
 	}
 
-	dot := DockerOnTop{dotRootDir: dotRootDir}
+	dot := &DockerOnTop{dotRootDir: dotRootDir, pools: make(map[string]string), defaultPool: defaultPool}
+	for name, dir := range pools {
+		if dir[len(dir)-1] != '/' {
+			dir += "/"
+		}
+		dot.pools[name] = dir
+	}
 
 	entries, err := os.ReadDir(dotRootDir)
 	if err != nil {
@@ -52,6 +64,12 @@ func NewDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
 	mountedOverlaysFound := false
 	for _, entry := range entries {
 		volumeName := entry.Name()
+		// The quota image (see quota.go) is not mounted after a reboot, and it is needed for everything else. If it
+		// fails to mount (e.g., it is corrupt), the volume fails to be mounted, but the others are still usable
+		if err = dot.volumeTreeMountQuota(volumeName); err != nil {
+			log.Errorf("Failed to mount the quota image of volume %s: %v. Skipping the volume", volumeName, err)
+			continue
+		}
 		err = dot.volumeTreeOnBootReset(volumeName)
 		if err == nil {
 			log.Infof("Detected volume %s. The state was dirty, cleaned successfully", volumeName)
@@ -64,6 +82,11 @@ func NewDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
 			log.Errorf("Failed to reset volume %s on boot: %v", volumeName, err)
 			return nil, err
 		}
+		// The plugin might have been stopped before it saved the volume's history generation (see
+		// `historySaveLater`)
+		if _, err = os.Stat(dot.historypendingmarker(volumeName)); err == nil {
+			go dot.historySaveInBackground(volumeName)
+		}
 	}
 
 	if mountedOverlaysFound {
@@ -74,14 +97,35 @@ func NewDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
 			"discarded. In any case, the machine reboot will fix everything. You can as well remove the volumes")
 	}
 
-	return &dot, nil
+	return dot, nil
+}
+
+// OpenDockerOnTop creates a new `DockerOnTop` object for an existing dot root directory. Unlike `NewDockerOnTop`, it
+// does not touch the volumes' state, so it is safe to use while the daemon is running (e.g., for admin commands).
+func OpenDockerOnTop(dotRootDir string) (*DockerOnTop, error) {
+	if len(dotRootDir) == 0 {
+		return nil, errors.New("`dotRootDir` cannot be empty")
+	}
+
+	if dotRootDir[len(dotRootDir)-1] != '/' {
+		dotRootDir += "/"
+	}
+
+	stat, err := os.Stat(dotRootDir)
+	if err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dotRootDir)
+	}
+
+	return &DockerOnTop{dotRootDir: dotRootDir}, nil
 }
 
 // MustNewDockerOnTop behaves as `NewDockerOnTop` but panics in case of an error
-func MustNewDockerOnTop(dotRootDir string) *DockerOnTop {
-	driver, err := NewDockerOnTop(dotRootDir)
+func MustNewDockerOnTop(dotRootDir string, pools map[string]string, defaultPool string) *DockerOnTop {
+	driver, err := NewDockerOnTop(dotRootDir, pools, defaultPool)
 	if err != nil {
-		panic(fmt.Errorf("the call NewDockerOnTop(%+v) failed: %v", dotRootDir, err))
+		panic(fmt.Errorf("the call NewDockerOnTop(%+v, %+v, %+v) failed: %v", dotRootDir, pools, defaultPool, err))
 	}
 	return driver
 }
@@ -7,8 +7,10 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
@@ -16,6 +18,22 @@ import (
 // This regex is based on the error message from docker daemon when requested to create a volume with invalid name
 var volNameFormat = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_.-]*$")
 
+// tmpfsSizeFormat is the format of the `size` option: a number of bytes with an optional k, m, or g suffix, or a
+// percentage of RAM, just like tmpfs's "size" option
+var tmpfsSizeFormat = regexp.MustCompile("^[0-9]+([kKmMgG%])?$")
+
+// parseBoolOption parses the boolean volume option `name` (false if it is not set).
+func parseBoolOption(options map[string]string, name string) (bool, error) {
+	switch strings.ToLower(options[name]) {
+	case "", "no", "false":
+		return false, nil
+	case "yes", "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("option `%s` must be either 'true', 'false', 'yes', or 'no'", name)
+	}
+}
+
 func (d *DockerOnTop) Create(request *volume.CreateRequest) error {
 	log.Debugf("Request Create: Name=%s Options=%s", request.Name, request.Options)
 
@@ -30,7 +48,16 @@ func (d *DockerOnTop) Create(request *volume.CreateRequest) error {
 			"it should comply to \"[a-zA-Z0-9][a-zA-Z0-9_.-]*\"")
 	}
 
-	allowedOptions := map[string]bool{"base": true, "volatile": true} // Values are meaningless, only keys matter
+	allowedOptions := map[string]bool{"base": true, "volatile": true, "history": true, "clonefrom": true,
+		"basevolume": true, "nosync": true, "trash": true, "trashmaxage": true,
+		"sharing": true, "exclusive": true, "upper": true, "size": true, "quota": true,
+		"quotamode": true, "quotainodes": true, "pool": true}
+	for _, flag := range overlayMountFlagNames() {
+		allowedOptions[flag] = true
+	}
+	for name := range overlayOptions {
+		allowedOptions[name] = true
+	} // Values are meaningless, only keys matter
 	for opt := range request.Options {
 		if _, ok := allowedOptions[opt]; !ok {
 			log.Debugf("Unknown option %s. Volume not created", opt)
@@ -38,19 +65,75 @@ func (d *DockerOnTop) Create(request *volume.CreateRequest) error {
 		}
 	}
 
-	baseDir, ok := request.Options["base"]
-	if !ok {
-		log.Debug("No `base` option was provided. Volume not created")
-		return errors.New("`base` option must be provided and set to an absolute path to the base directory on host")
+	var baseDirs []string
+	var source VolumeInfo
+	baseVolume, chained := request.Options["basevolume"]
+	sourceName, clone := request.Options["clonefrom"]
+	if clone {
+		_, hasBase := request.Options["base"]
+		_, hasBaseVolume := request.Options["basevolume"]
+		if hasBase || hasBaseVolume {
+			log.Debug("`base` or `basevolume` option was provided together with `clonefrom`. Volume not created")
+			return errors.New("`base` and `basevolume` cannot be specified for a clone: they are the same as for " +
+				"the original volume")
+		}
+		var err error
+		source, err = d.getVolumeInfo(sourceName)
+		if os.IsNotExist(err) || !volNameFormat.MatchString(sourceName) {
+			log.Debugf("The volume to clone %s does not exist. Volume not created", sourceName)
+			return errors.New("the volume to clone does not exist")
+		} else if err != nil {
+			log.Errorf("Failed to retrieve metadata for volume %s: %v", sourceName, err)
+			return internalError("failed to retrieve the metadata of the volume to clone", err)
+		}
+		baseDirs, baseVolume = source.BaseDirPaths, source.BaseVolume
+	} else if chained {
+		if _, hasBase := request.Options["base"]; hasBase {
+			log.Debug("Both `base` and `basevolume` options were provided. Volume not created")
+			return errors.New("`base` and `basevolume` cannot be specified together")
+		} else if baseVolume == request.Name {
+			log.Debug("`basevolume` is the volume itself. Volume not created")
+			return errors.New("a volume cannot be its own base volume")
+		}
+	} else {
+		baseOpt, ok := request.Options["base"]
+		if !ok {
+			log.Debug("No `base` option was provided. Volume not created")
+			return errors.New("`base` option must be provided and set to an absolute path to the base directory " +
+				"on host (or several colon-separated paths)")
+		}
+		baseDirs = splitBaseDirs(baseOpt)
 	}
 
-	if len(baseDir) < 1 || baseDir[0] != '/' {
-		log.Debug("`base` is not an absolute path. Volume not created")
-		return errors.New("`base` must be an absolute path")
-	} else if strings.ContainsRune(baseDir, ',') || strings.ContainsRune(baseDir, ':') {
-		log.Debug("`base` contains a comma or a colon. Volume not created")
-		return errors.New("directories with commas and/or colons in the path are not supported")
-	} else {
+	if baseVolume != "" {
+		if !volNameFormat.MatchString(baseVolume) {
+			log.Debugf("The base volume %s does not exist. Volume not created", baseVolume)
+			return errors.New("the base volume does not exist")
+		}
+		// Holding the base volume's lock until the new volume is created, so that the base volume is not removed in
+		// the meantime (see `DockerOnTop.Remove`)
+		var activemountsdir lockedFile
+		if _, err := os.Stat(d.activemountsdir(baseVolume)); os.IsNotExist(err) {
+			log.Debugf("The base volume %s does not exist. Volume not created", baseVolume)
+			return errors.New("the base volume does not exist")
+		} else if err = activemountsdir.Open(d.activemountsdir(baseVolume)); err != nil {
+			// The error is already logged and wrapped in `internalError` in lockedFile.go
+			return err
+		}
+		defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+		if _, err := d.volumeLowerDirs(baseVolume); err != nil {
+			log.Errorf("Failed to resolve the lower layers of the base volume %s: %v", baseVolume, err)
+			return internalError("failed to resolve the base volume", err)
+		}
+	}
+
+	for _, baseDir := range baseDirs {
+		if len(baseDir) < 1 || baseDir[0] != '/' {
+			log.Debugf("`base` %s is not an absolute path. Volume not created", baseDir)
+			return errors.New("`base` must be an absolute path (or several colon-separated absolute paths)")
+		}
+
 		// Check that the base directory exists
 
 		f, err := os.Open(baseDir)
@@ -59,31 +142,242 @@ func (d *DockerOnTop) Create(request *volume.CreateRequest) error {
 			// does by default with bind mounts), as the point of docker-on-top is to let containers work _on top_ of
 			// an existing host directory, so implicitly making an empty one would be pointless.
 			log.Debugf("The base directory %s does not exist. Volume not created", baseDir)
-			return errors.New("the base directory does not exist")
+			return fmt.Errorf("the base directory %s does not exist", baseDir)
 		} else if err != nil {
 			log.Errorf("Failed to open base directory: %v. Volume not created", err)
-			return fmt.Errorf("the specified base directory is inaccessible: %w", err)
+			return fmt.Errorf("the specified base directory %s is inaccessible: %w", baseDir, err)
 		} else {
 			_ = f.Close()
 		}
 	}
 
-	var volatile bool
-	volatileS, ok := request.Options["volatile"]
+	var volatileMode string
+	switch strings.ToLower(request.Options["volatile"]) {
+	case "", "no", "false":
+		volatileMode = ""
+	case "yes", "true", volatileDiscardOnMount:
+		volatileMode = volatileDiscardOnMount
+	case volatileDiscardOnUnmount:
+		volatileMode = volatileDiscardOnUnmount
+	case volatileDiscardOnRemove:
+		volatileMode = volatileDiscardOnRemove
+	default:
+		log.Debug("Option `volatile` has an invalid value. Volume not created")
+		return errors.New("option `volatile` must be either 'true', 'false', 'yes', 'no', or one of the modes " +
+			"'mount', 'unmount', 'remove'")
+	}
+	volatile := volatileMode != ""
+
+	var private bool
+	switch strings.ToLower(request.Options["sharing"]) {
+	case "", "shared":
+		private = false
+	case "private":
+		private = true
+	default:
+		log.Debug("Option `sharing` has an invalid value. Volume not created")
+		return errors.New("option `sharing` must be either 'shared' or 'private'")
+	}
+	if private && volatile {
+		log.Debug("Private volume is requested to be volatile. Volume not created")
+		return errors.New("option `volatile` is not supported for private volumes (the changes made by each " +
+			"container are discarded anyway)")
+	}
+
+	var mountFlags []string
+	for _, flag := range overlayMountFlagNames() {
+		set, err := parseBoolOption(request.Options, flag)
+		if err != nil {
+			log.Debugf("Option `%s` has an invalid value. Volume not created", flag)
+			return err
+		} else if set {
+			mountFlags = append(mountFlags, flag)
+		}
+	}
+
+	overlayOpts := make(map[string]string)
+	for name, values := range overlayOptions {
+		value, ok := request.Options[name]
+		if values == nil {
+			set, err := parseBoolOption(request.Options, name)
+			if err != nil {
+				log.Debugf("Option `%s` has an invalid value. Volume not created", name)
+				return err
+			} else if set {
+				overlayOpts[name] = ""
+			}
+		} else if ok {
+			if !containsString(values, strings.ToLower(value)) {
+				log.Debugf("Option `%s` has an invalid value. Volume not created", name)
+				return fmt.Errorf("option `%s` must be one of %s", name, strings.Join(values, ", "))
+			}
+			overlayOpts[name] = strings.ToLower(value)
+		}
+	}
+	if clone && len(overlayOpts) == 0 {
+		// The copied upperdir is in the format of the original volume's options (e.g., `userxattr` changes the
+		// namespace of the overlay xattrs), so the clone keeps them, unless told otherwise
+		for name, value := range source.OverlayOptions {
+			if name != "volatile" { // Depends on the `nosync` option, see below
+				overlayOpts[name] = value
+			}
+		}
+	}
+
+	exclusive, err := parseBoolOption(request.Options, "exclusive")
+	if err != nil {
+		log.Debug("Option `exclusive` has an invalid value. Volume not created")
+		return err
+	}
+
+	nosync, err := parseBoolOption(request.Options, "nosync")
+	if err != nil {
+		log.Debug("Option `nosync` has an invalid value. Volume not created")
+		return err
+	} else if nosync && !volatile && !private {
+		log.Debug("Option `nosync` is set for a non-volatile volume. Volume not created")
+		return errors.New("option `nosync` is only supported for volatile and private volumes")
+	} else if nosync {
+		// The changes of a volatile volume are discarded anyway, so there's no need to sync them to the disk.
+		// Note: overlayfs's "volatile" has nothing to do with docker-on-top's volatile volumes otherwise
+		overlayOpts["volatile"] = ""
+	}
+
+	var history int
+	if historyS, ok := request.Options["history"]; ok {
+		history, err = strconv.Atoi(historyS)
+		if err != nil || history < 0 {
+			log.Debug("Option `history` has an invalid value. Volume not created")
+			return errors.New("option `history` must be a non-negative integer")
+		}
+		if (volatile || private) && history > 0 {
+			log.Debug("Option `history` is set for a volatile or private volume. Volume not created")
+			return errors.New("option `history` is not supported for volatile and private volumes")
+		}
+	}
+
+	var trash int
+	if trashS, ok := request.Options["trash"]; ok {
+		trash, err = strconv.Atoi(trashS)
+		if err != nil || trash < 0 {
+			log.Debug("Option `trash` has an invalid value. Volume not created")
+			return errors.New("option `trash` must be a non-negative integer")
+		}
+	}
+	var trashMaxAge time.Duration
+	if trashMaxAgeS, ok := request.Options["trashmaxage"]; ok {
+		trashMaxAge, err = time.ParseDuration(trashMaxAgeS)
+		if err != nil || trashMaxAge < 0 {
+			log.Debug("Option `trashmaxage` has an invalid value. Volume not created")
+			return errors.New("option `trashmaxage` must be a non-negative duration, such as 72h")
+		}
+	}
+	if (trash > 0 || trashMaxAge > 0) && volatileMode != volatileDiscardOnMount &&
+		volatileMode != volatileDiscardOnUnmount {
+		// In the 'remove' mode, the changes are only discarded together with the volume (and its trash)
+		log.Debug("Trash is enabled for a volume whose changes are never discarded. Volume not created")
+		return errors.New("options `trash` and `trashmaxage` are only supported for volatile volumes with the " +
+			"'mount' or 'unmount' mode")
+	}
+
+	quotaMode := strings.ToLower(request.Options["quotamode"])
+	switch quotaMode {
+	case "", quotaModeImage:
+		quotaMode = "" // The default
+	case quotaModeProject:
+	default:
+		log.Debug("Option `quotamode` has an invalid value. Volume not created")
+		return errors.New("option `quotamode` must be either 'image' or 'project'")
+	}
+	var quota int64
+	var quotaInodes uint64
+	if quotaS, ok := request.Options["quota"]; ok {
+		quota, err = parseByteSize(quotaS)
+		if err != nil {
+			log.Debug("Option `quota` has an invalid value. Volume not created")
+			return fmt.Errorf("option `quota` %v", err)
+		} else if quota == 0 {
+			log.Debug("Option `quota` is zero. Volume not created")
+			return errors.New("option `quota` must be positive")
+		} else if quotaMode == "" && quota < quotaMinSize {
+			log.Debug("Option `quota` is too small. Volume not created")
+			return fmt.Errorf("option `quota` must be at least %dm", quotaMinSize>>20)
+		} else if volatile || private {
+			log.Debug("Option `quota` is set for a volatile or private volume. Volume not created")
+			return errors.New("option `quota` is only supported for non-volatile shared volumes (for volatile " +
+				"volumes, consider `upper=tmpfs` with `size`)")
+		}
+	}
+	if quotaInodesS, ok := request.Options["quotainodes"]; ok {
+		quotaInodes, err = strconv.ParseUint(quotaInodesS, 10, 64)
+		if err != nil {
+			log.Debug("Option `quotainodes` has an invalid value. Volume not created")
+			return errors.New("option `quotainodes` must be a non-negative integer")
+		}
+	}
+	if quota == 0 && (quotaMode != "" || quotaInodes > 0) {
+		log.Debug("Quota options are set without `quota`. Volume not created")
+		return errors.New("options `quotamode` and `quotainodes` require `quota`")
+	} else if quotaInodes > 0 && quotaMode != quotaModeProject {
+		log.Debug("Option `quotainodes` is set for an image quota. Volume not created")
+		return errors.New("option `quotainodes` is only supported with `quotamode=project`")
+	}
+
+	var upperTmpfs bool
+	switch strings.ToLower(request.Options["upper"]) {
+	case "", "disk":
+		upperTmpfs = false
+	case "tmpfs":
+		upperTmpfs = true
+	default:
+		log.Debug("Option `upper` has an invalid value. Volume not created")
+		return errors.New("option `upper` must be either 'disk' or 'tmpfs'")
+	}
+	tmpfsSize, sized := request.Options["size"]
+	if sized && !upperTmpfs {
+		log.Debug("Option `size` is set without `upper=tmpfs`. Volume not created")
+		return errors.New("option `size` is only supported together with `upper=tmpfs`")
+	} else if sized && !tmpfsSizeFormat.MatchString(tmpfsSize) {
+		log.Debug("Option `size` has an invalid value. Volume not created")
+		return errors.New("option `size` must be a number of bytes with an optional k, m, or g suffix (e.g., 2g), " +
+			"or a percentage of RAM (e.g., 10%)")
+	}
+	if upperTmpfs && (volatileMode != volatileDiscardOnMount && volatileMode != volatileDiscardOnUnmount ||
+		trash > 0 || trashMaxAge > 0 || clone) {
+		// The changes on the tmpfs are lost when the volume is unmounted
+		log.Debug("Option `upper=tmpfs` is set for a volume whose changes are kept. Volume not created")
+		return errors.New("option `upper=tmpfs` is only supported for volatile volumes with the 'mount' or " +
+			"'unmount' mode, without trash, and not for clones")
+	}
+
+	pool, ok := request.Options["pool"]
 	if !ok {
-		volatileS = "false"
+		pool = d.defaultPool
 	}
-	volatileS = strings.ToLower(volatileS)
-	if volatileS == "no" || volatileS == "false" {
-		volatile = false
-	} else if volatileS == "yes" || volatileS == "true" {
-		volatile = true
-	} else {
-		log.Debug("Option `volatile` has an invalid value. Volume not created")
-		return errors.New("option `volatile` must be either 'true', 'false', 'yes', or 'no'")
+	poolDir, ok := d.pools[pool]
+	if pool != "" && !ok {
+		log.Debugf("Pool %s is not configured. Volume not created", pool)
+		return fmt.Errorf("no such pool %s (the pools are set in the plugin's config)", pool)
 	}
 
-	if err := d.volumeTreeCreate(request.Name); err != nil {
+	var projectID uint32
+	if quotaMode == quotaModeProject {
+		// Holding the lock until the metadata is written, so that no other volume gets the same project ID
+		var dotRootDir lockedFile
+		if err := dotRootDir.Open(d.dotRootDir); err != nil {
+			// The error is already logged and wrapped in `internalError` in lockedFile.go
+			return err
+		}
+		defer dotRootDir.Close() // There's nothing I can do about the error if it occurs
+
+		projectID, err = d.nextProjectID()
+		if err != nil {
+			log.Errorf("Failed to assign a project ID: %v", err)
+			return internalError("failed to assign a project ID", err)
+		}
+	}
+
+	if err := d.volumeTreeCreate(request.Name, poolDir); err != nil {
 		if os.IsExist(err) {
 			log.Debug("Volume's main directory already exists. New volume not created")
 			return errors.New("volume already exists")
@@ -93,13 +387,60 @@ func (d *DockerOnTop) Create(request *volume.CreateRequest) error {
 		}
 	}
 
-	if err := d.writeVolumeInfo(request.Name, VolumeInfo{BaseDirPath: baseDir, Volatile: volatile}); err != nil {
+	vol := VolumeInfo{BaseDirPaths: baseDirs, BaseVolume: baseVolume, Volatile: volatile,
+		VolatileMode: volatileMode, Private: private, Exclusive: exclusive, UpperTmpfs: upperTmpfs,
+		TmpfsSize: tmpfsSize, Quota: quota, QuotaMode: quotaMode, QuotaInodes: quotaInodes, ProjectID: projectID,
+		History: history, Trash: trash, TrashMaxAge: trashMaxAge, Pool: pool, MountFlags: mountFlags,
+		OverlayOptions: overlayOpts, CreatedAt: time.Now()}
+	if err := d.writeVolumeInfo(request.Name, vol); err != nil {
 		log.Errorf("Failed to write metadata for volume %s: %v. Aborting volume creation (attempting "+
 			"to destroy the volume's tree)", request.Name, err)
 		_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
 		return internalError("failed to store metadata for the volume", err)
 	}
 
+	if projectID != 0 {
+		if err := d.volumeTreeCreateProjectQuota(request.Name, projectID, quota, quotaInodes); err != nil {
+			_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
+			// The error is already logged by `d.volumeTreeCreateProjectQuota`
+			return err
+		}
+	} else if quota > 0 {
+		if err := d.volumeTreeCreateQuota(request.Name, quota); err != nil {
+			_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
+			// The error is already logged and wrapped in `internalError` by `d.volumeTreeCreateQuota`
+			return err
+		}
+	}
+
+	// The upperdir is only created above, when the metadata (with the base) is not written yet
+	if err := d.volumeTreeCopyBaseRoot(request.Name, d.upperdir(request.Name)); err != nil {
+		log.Errorf("Failed to copy the attributes of the base's root to the upperdir of %s: %v. Aborting volume "+
+			"creation (attempting to destroy the volume's tree)", request.Name, err)
+		_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
+		return internalError("failed to copy the attributes of the base's root", err)
+	}
+
+	if clone {
+		if err := d.volumeTreeCloneUpper(request.Name, sourceName); err != nil {
+			log.Errorf("Failed to clone volume %s. Aborting volume creation (attempting to destroy the "+
+				"volume's tree)", sourceName)
+			_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
+			// The error is already logged and wrapped in `internalError` by `d.volumeTreeCloneUpper`
+			return err
+		}
+	}
+
+	if len(overlayOpts) > 0 {
+		// The overlay options might be unsupported by the kernel (or in combination with each other or with the base
+		// directories' filesystem), which is only detected when the overlay is mounted. Thus, mounting it once
+		if err := d.probeMount(request.Name); err != nil {
+			_ = d.volumeTreeDestroy(request.Name) // The errors are logged, if any
+			// The error is already logged by `d.probeMount`
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -113,7 +454,13 @@ func (d *DockerOnTop) List() (*volume.ListResponse, error) {
 		return nil, internalError("failed to list contents of the dot root directory", err)
 	}
 	for _, volMainDir := range entries {
-		response.Volumes = append(response.Volumes, &volume.Volume{Name: volMainDir.Name()})
+		vol, err := d.volumeStatus(volMainDir.Name())
+		if err != nil {
+			// The error is already logged by `d.volumeStatus`. Still listing the volume (just its name), so that
+			// a single broken volume does not break the listing of all the other ones
+			vol = &volume.Volume{Name: volMainDir.Name()}
+		}
+		response.Volumes = append(response.Volumes, vol)
 	}
 	return &response, nil
 }
@@ -128,8 +475,13 @@ func (d *DockerOnTop) Get(request *volume.GetRequest) (*volume.GetResponse, erro
 	dir, err := os.Open(d.dotRootDir + request.Name)
 	if err == nil {
 		_ = dir.Close()
-		log.Debug("Found volume. Listing it (just its name)")
-		return &volume.GetResponse{Volume: &volume.Volume{Name: request.Name}}, nil
+		log.Debug("Found volume. Collecting its status")
+		vol, err := d.volumeStatus(request.Name)
+		if err != nil {
+			// The error is already logged and wrapped in `internalError` by `d.volumeStatus`
+			return nil, err
+		}
+		return &volume.GetResponse{Volume: vol}, nil
 	} else if os.IsNotExist(err) {
 		log.Debug("The requested volume does not exist")
 		return nil, errors.New("no such volume")
@@ -142,6 +494,26 @@ func (d *DockerOnTop) Get(request *volume.GetRequest) (*volume.GetResponse, erro
 func (d *DockerOnTop) Remove(request *volume.RemoveRequest) error {
 	log.Debugf("Request Remove: Name=%s. It will succeed regardless of the presence of the volume", request.Name)
 
+	// Refuse to remove a volume that other volumes are stacked on. Holding the lock until the volume is removed, so
+	// that no such volumes are created in the meantime (see `DockerOnTop.Create`)
+	if _, err := os.Stat(d.activemountsdir(request.Name)); err == nil {
+		var activemountsdir lockedFile
+		if err = activemountsdir.Open(d.activemountsdir(request.Name)); err != nil {
+			// The error is already logged and wrapped in `internalError` in lockedFile.go
+			return err
+		}
+		defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+		children, err := d.volumeChildren(request.Name)
+		if err != nil {
+			log.Errorf("Failed to list the volumes based on %s: %v", request.Name, err)
+			return internalError("failed to check if other volumes are based on the volume", err)
+		} else if len(children) > 0 {
+			log.Debugf("Volume %s is the base of %v. Not removing", request.Name, children)
+			return fmt.Errorf("the volume is the base volume of %s; remove them first", strings.Join(children, ", "))
+		}
+	}
+
 	// If dockerd sent us this request, it means no containers are using the volume.
 	// Under normal operation, it means that mountpoint must not exist already.
 	//
@@ -175,24 +547,49 @@ func (d *DockerOnTop) Remove(request *volume.RemoveRequest) error {
 			err)
 	}
 
-	err = os.RemoveAll(d.dotRootDir + request.Name)
+	// Same for the private overlays, if any
+	ids, err := d.privateMountIds(request.Name)
 	if err != nil {
-		// This potentially leaves volume directory in an inconsistent state :(
-		log.Errorf("Failed to RemoveAll main directory for volume %s: %v", request.Name, err)
-		return internalError("failed to RemoveAll volume main directory", err)
+		log.Errorf("Failed to list private mounts of volume %s to be removed: %v", request.Name, err)
+		return internalError("failed to list the private mounts when removing", err)
 	}
-	return nil
+	for _, id := range ids {
+		err = d.removePrivateMount(request.Name, id, syscall.MNT_FORCE|syscall.MNT_DETACH)
+		if err != nil {
+			// The error is already logged and wrapped in `internalError` by `d.removePrivateMount`
+			return err
+		}
+	}
+
+	// The error is already logged and wrapped in `internalError` by `d.volumeTreeDestroy`. If it occurs, this
+	// potentially leaves volume directory in an inconsistent state :(
+	return d.volumeTreeDestroy(request.Name)
 }
 
 func (d *DockerOnTop) Path(request *volume.PathRequest) (*volume.PathResponse, error) {
 	log.Debugf("Request Path: Name=%s", request.Name)
+
+	vol, err := d.getVolumeInfo(request.Name)
+	if os.IsNotExist(err) {
+		log.Debugf("Couldn't get volume info: %v", err)
+		return nil, errors.New("no such volume")
+	} else if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", request.Name, err)
+		return nil, internalError("failed to retrieve the volume's metadata", err)
+	}
+
+	if vol.Private {
+		// Every container has its own mountpoint (see privateMount.go), and the shared one is never mounted. They are
+		// listed in the volume's status instead
+		return &volume.PathResponse{}, nil
+	}
 	return &volume.PathResponse{Mountpoint: d.mountpointdir(request.Name)}, nil
 }
 
 func (d *DockerOnTop) Mount(request *volume.MountRequest) (*volume.MountResponse, error) {
 	log.Debugf("Request Mount: ID=%s, Name=%s", request.ID, request.Name)
 
-	_, err := d.getVolumeInfo(request.Name)
+	vol, err := d.getVolumeInfo(request.Name)
 	if os.IsNotExist(err) {
 		log.Debugf("Couldn't get volume info: %v", err)
 		return nil, errors.New("no such volume")
@@ -218,6 +615,9 @@ func (d *DockerOnTop) Mount(request *volume.MountRequest) (*volume.MountResponse
 	err = d.activateVolume(request.Name, request.ID, activemountsdir)
 	if err == nil {
 		mountpoint := d.mountpointdir(request.Name)
+		if vol.Private {
+			mountpoint = d.privateMountpoint(request.Name, request.ID)
+		}
 		response := volume.MountResponse{Mountpoint: mountpoint}
 		return &response, nil
 	} else {
@@ -277,24 +677,52 @@ func (d *DockerOnTop) activateVolume(volumeName string, requestId string, active
 		panic(err)
 	}
 
-	_, err = activemountsdir.ReadDir(1) // Check if there are any files inside activemounts dir
-	if errors.Is(err, io.EOF) {
+	if thisVol.Exclusive {
+		// Only one container may use the volume. Repeated mounts with the same ID are not another container
+		// (see `activeMount`)
+		entries, err := os.ReadDir(d.activemountsdir(volumeName))
+		if err != nil {
+			log.Errorf("Failed to list the activemounts directory: %v", err)
+			return internalError("failed to list activemounts/", err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != requestId {
+				log.Debugf("Exclusive volume %s is already used by %s. Refusing to mount it for %s", volumeName,
+					entry.Name(), requestId)
+				return fmt.Errorf("volume %s is exclusive and is already in use by another container", volumeName)
+			}
+		}
+	}
+
+	if thisVol.Private {
+		// Every container gets its own overlay (see privateMount.go). The error is already logged by
+		// `d.activatePrivateMount`
+		if err = d.activatePrivateMount(volumeName, requestId, thisVol); err != nil {
+			return err
+		}
+	} else if _, err = activemountsdir.ReadDir(1); errors.Is(err, io.EOF) {
 		// No files => no other containers are using the volume. Need to mount the overlay
 
-		lowerdir := thisVol.BaseDirPath
-		upperdir := d.upperdir(volumeName)
-		workdir := d.workdir(volumeName)
+		lowers, err := d.volumeLowerDirs(volumeName)
+		if err != nil {
+			log.Errorf("Failed to resolve the lower layers of volume %s: %v", volumeName, err)
+			return internalError("failed to resolve the base volume", err)
+		}
+		upperdir, workdir := d.overlayDirs(volumeName, thisVol)
 		mountpoint := d.mountpointdir(volumeName)
 
-		err = d.volumeTreePreMount(volumeName, thisVol.Volatile)
+		// The changes of the previous use are saved in the background (see `historySaveLater`), which takes the
+		// same lock. If it has not got to them yet, the mount is not delayed for the copying
+		d.historyDropPending(volumeName)
+
+		err = d.volumeTreePreMount(volumeName, thisVol.VolatileMode == volatileDiscardOnMount)
 		if err != nil {
 			// The error is already logged and wrapped in `internalError` by `d.volumeTreePreMount`
 			return err
 		}
 
-		options := "lowerdir=" + lowerdir + ",upperdir=" + upperdir + ",workdir=" + workdir
-
-		err = syscall.Mount("docker-on-top_"+volumeName, mountpoint, "overlay", 0, options)
+		err = mountOverlay("docker-on-top_"+volumeName, mountpoint, lowers, upperdir, workdir, thisVol.MountFlags,
+			thisVol.OverlayOptions)
 		if os.IsNotExist(err) {
 			log.Errorf("Failed to mount overlay for volume %s because something does not exist: %v",
 				volumeName, err)
@@ -418,6 +846,15 @@ func (d *DockerOnTop) deactivateVolume(volumeName string, requestId string, acti
 		return nil
 	}
 
+	thisVol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		panic(err)
+	}
+	if thisVol.Private {
+		// The error is already logged and wrapped in `internalError` by `d.removePrivateMount`
+		return d.removePrivateMount(volumeName, requestId, 0)
+	}
+
 	_, err = activemountsdir.ReadDir(1) // Check if there is any container using the volume (after us)
 	if errors.Is(err, io.EOF) {
 		err = syscall.Unmount(d.mountpointdir(volumeName), 0)
@@ -427,7 +864,28 @@ func (d *DockerOnTop) deactivateVolume(volumeName string, requestId string, acti
 		}
 
 		err = d.volumeTreePostUnmount(volumeName)
-		return err
+		if err != nil {
+			return err
+		}
+
+		if thisVol.VolatileMode == volatileDiscardOnUnmount {
+			// The upperdir is a lower layer of the volumes stacked on this one, so it must not be modified while any
+			// of them is mounted. The changes are then kept until the next unmount
+			release, err := d.lockIdleDependents(volumeName, d.upperdir(volumeName))
+			if err != nil {
+				log.Warningf("Not discarding the changes of %s: %v", volumeName, err)
+				return nil
+			}
+			defer release()
+			// The error is already logged and wrapped in `internalError` by `d.volumeTreeDiscardUpper`
+			return d.volumeTreeDiscardUpper(volumeName)
+		}
+		if thisVol.History > 0 {
+			// The volume is already unmounted, so failing the request would not help. The error is logged
+			// by `d.historySaveLater`
+			_ = d.historySaveLater(volumeName)
+		}
+		return nil
 	} else if err == nil {
 		log.Debugf("Volume %s is still mounted in another container. Indicating success without unmounting",
 			volumeName)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// fsckIssue is an inconsistency in a volume's tree, found by `DockerOnTop.fsckVolume`.
+type fsckIssue struct {
+	Problem string
+	// Repaired tells whether the problem has been fixed
+	Repaired bool
+}
+
+// fsckVolume checks the volume's tree for inconsistencies, which might be caused by a third party interfering with the
+// dot root directory or by the plugin being terminated abruptly. If `repair` is set, the problems that can be fixed
+// safely are fixed.
+//
+// The check is performed under the same lock that `DockerOnTop.Mount` and `DockerOnTop.Unmount` take, so it is safe
+// to run while the daemon is running. If the volume cannot be checked at all (e.g., the lock cannot be taken),
+// an error is returned. Errors are logged.
+func (d *DockerOnTop) fsckVolume(volumeName string, repair bool) ([]fsckIssue, error) {
+	var issues []fsckIssue
+	report := func(repaired bool, format string, args ...interface{}) {
+		issues = append(issues, fsckIssue{Problem: fmt.Sprintf(format, args...), Repaired: repaired})
+	}
+
+	stat, err := os.Stat(d.dotRootDir + volumeName)
+	if err != nil {
+		log.Errorf("Failed to stat main directory of %s: %v", volumeName, err)
+		return nil, internalError("failed to stat the volume's main directory", err)
+	} else if !stat.IsDir() {
+		report(false, "%s is not a directory", d.dotRootDir+volumeName)
+		return issues, nil
+	}
+
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		report(false, "metadata is missing or corrupt: %v", err)
+	} else if vol.BaseVolume != "" {
+		if _, err = d.volumeLowerDirs(volumeName); err != nil {
+			report(false, "base volume cannot be resolved: %v", err)
+		}
+	} else {
+		for _, baseDir := range vol.BaseDirPaths {
+			if _, err = os.Stat(baseDir); err != nil {
+				report(false, "base directory is inaccessible: %v", err)
+			}
+		}
+	}
+
+	// Without activemounts/, it's not even possible to take the lock
+	if _, err = os.Stat(d.activemountsdir(volumeName)); os.IsNotExist(err) {
+		repaired := repair && os.Mkdir(d.activemountsdir(volumeName), os.ModePerm) == nil
+		report(repaired, "activemounts/ directory is missing")
+		if !repaired {
+			return issues, nil
+		}
+	}
+
+	var activemountsdir lockedFile
+	err = activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return nil, err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	if _, err = os.Stat(d.upperdir(volumeName)); os.IsNotExist(err) {
+		repaired := repair && os.Mkdir(d.upperdir(volumeName), os.ModePerm) == nil
+		if repaired {
+			_ = d.volumeTreeCopyBaseRoot(volumeName, d.upperdir(volumeName)) // Not critical, the volume is usable
+		}
+		report(repaired, "upper/ directory is missing (the changes made to the volume are lost)")
+	}
+
+	entries, err := os.ReadDir(d.activemountsdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to list the activemounts directory: %v", err)
+		return nil, internalError("failed to list activemounts/", err)
+	}
+	activeMounts := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		// An active mount file that cannot be decoded would make the volume stuck in the active state, as
+		// `deactivateVolume` would fail. As the file exists, the mount is considered active, used once.
+		path := d.activemountsdir(volumeName) + entry.Name()
+		var am activeMount
+		payload, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(payload, &am)
+		}
+		if err != nil || am.UsageCount <= 0 {
+			am = activeMount{UsageCount: 1}
+			repaired := repair && os.WriteFile(path, am.mustMarshal(), 0o644) == nil
+			report(repaired, "active mount file %s is corrupt", entry.Name())
+		}
+		activeMounts[entry.Name()] = am.UsageCount
+	}
+
+	// The repairs below are destructive if it's wrong, so not relying on the heuristic of `isMountpoint`
+	mounted, err := isListedMountpoint(d.mountpointdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to check if volume %s is mounted: %v", volumeName, err)
+		return nil, internalError("failed to check if the volume is mounted", err)
+	}
+
+	if vol.Private {
+		if err = d.fsckPrivateMounts(volumeName, activeMounts, repair, report); err != nil {
+			// The error is already logged and wrapped in `internalError` by `d.fsckPrivateMounts`
+			return nil, err
+		}
+	} else if mounted && len(activeMounts) == 0 {
+		repaired := repair && d.fsckUnmount(volumeName) == nil
+		report(repaired, "overlay is mounted, but no container is using the volume")
+	} else if !mounted && len(activeMounts) > 0 {
+		ids := make([]string, 0, len(activeMounts))
+		for id := range activeMounts {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		// This is the dangerous state described in the conceptual note in driver.go: the next container
+		// would get an empty mountpoint. Since the overlay is not mounted, no container can actually be
+		// using the volume, so it is safe to forget the active mounts.
+		repaired := repair
+		for _, id := range ids {
+			if repair && os.Remove(d.activemountsdir(volumeName)+id) != nil {
+				repaired = false
+			}
+		}
+		if repaired {
+			repaired = d.fsckUnmount(volumeName) == nil
+		}
+		report(repaired, "volume is marked as used by %s, but the overlay is not mounted", strings.Join(ids, ", "))
+	} else if !mounted {
+		for _, dir := range []string{d.mountpointdir(volumeName), d.workdir(volumeName)} {
+			if _, err = os.Stat(dir); err == nil {
+				repaired := repair && d.fsckUnmount(volumeName) == nil
+				report(repaired, "%s is left over from a previous mount", dir)
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// fsckPrivateMounts checks that the private overlays (see privateMount.go) are mounted for exactly the active mounts
+// of the volume and reports the problems with `report`. If `repair` is set, the problems are fixed. Errors are logged
+// and wrapped with `internalError`.
+func (d *DockerOnTop) fsckPrivateMounts(volumeName string, activeMounts map[string]int, repair bool,
+	report func(repaired bool, format string, args ...interface{})) error {
+	ids, err := d.privateMountIds(volumeName)
+	if err != nil {
+		log.Errorf("Failed to list private mounts of volume %s: %v", volumeName, err)
+		return internalError("failed to list the private mounts", err)
+	}
+	for _, id := range ids {
+		if _, active := activeMounts[id]; !active {
+			repaired := repair && d.removePrivateMount(volumeName, id, 0) == nil
+			report(repaired, "private overlay of %s is left over, but %s is not using the volume", id, id)
+		}
+	}
+
+	activeIds := make([]string, 0, len(activeMounts))
+	for id := range activeMounts {
+		activeIds = append(activeIds, id)
+	}
+	sort.Strings(activeIds)
+	for _, id := range activeIds {
+		mounted, err := isListedMountpoint(d.privateMountpoint(volumeName, id))
+		if err != nil {
+			log.Errorf("Failed to check if volume %s is mounted for %s: %v", volumeName, id, err)
+			return internalError("failed to check if the private overlay is mounted", err)
+		} else if !mounted {
+			// Just like with a shared volume, it is safe to forget the active mount (see `DockerOnTop.fsckVolume`)
+			repaired := repair && os.Remove(d.activemountsdir(volumeName)+id) == nil &&
+				d.removePrivateMount(volumeName, id, 0) == nil
+			report(repaired, "volume is marked as used by %s, but its private overlay is not mounted", id)
+		}
+	}
+	return nil
+}
+
+// fsckUnmount unmounts the volume's overlay, if it is mounted, and removes its mountpoint/ and workdir/, if they
+// exist. Errors are logged.
+func (d *DockerOnTop) fsckUnmount(volumeName string) error {
+	mountpoint := d.mountpointdir(volumeName)
+	err := syscall.Unmount(mountpoint, 0)
+	if err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+		// EINVAL means it's not mounted
+		log.Errorf("Failed to unmount %s: %v", mountpoint, err)
+		return err
+	}
+	if err = os.Remove(mountpoint); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove %s: %v", mountpoint, err)
+		return err
+	}
+	if err = os.RemoveAll(d.workdir(volumeName)); err != nil {
+		log.Errorf("Failed to RemoveAll %s: %v", d.workdir(volumeName), err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The helpers in this file copy files with all of their attributes (ownership, mode, xattrs, timestamps), which is
+// needed to move the contents of upperdirs around without altering them.
+
+// listXattrs returns the names of the xattrs of the file at `path` (not following symlinks).
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// copyXattrs copies the xattrs of `src` to `dst` (not following symlinks). If `skipPrefix` is not empty, the xattrs
+// with names starting with it are not copied (e.g., the overlay xattrs, see `overlayXattrPrefix`). The xattrs that
+// `dst` has but `src` does not are left intact.
+func copyXattrs(src string, dst string, skipPrefix string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if skipPrefix != "" && strings.HasPrefix(name, skipPrefix) {
+			continue
+		}
+		size, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return &os.PathError{Op: "lgetxattr", Path: src, Err: err}
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return &os.PathError{Op: "lgetxattr", Path: src, Err: err}
+		}
+		if err = unix.Lsetxattr(dst, name, value[:size], 0); err != nil {
+			return &os.PathError{Op: "lsetxattr", Path: dst, Err: err}
+		}
+	}
+	return nil
+}
+
+// copyAttributes copies ownership, mode, and xattrs of `src` (described by `info`) to `dst`. Symlinks are not
+// followed. Timestamps are not copied, as they must be set after the contents of a directory is modified (see
+// `copyTimes`). `skipXattrPrefix` is passed to `copyXattrs`.
+func copyAttributes(src string, dst string, info fs.FileInfo, skipXattrPrefix string) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		// Note: `os.Chmod` does not support the setuid/setgid/sticky bits in the raw form
+		if err := syscall.Chmod(dst, stat.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: dst, Err: err}
+		}
+	}
+	return copyXattrs(src, dst, skipXattrPrefix)
+}
+
+// copyRootAttributes gives the directory `dst` the ownership, mode, and xattrs (except the ones starting with
+// `skipXattrPrefix`, the overlay xattrs) of the directory `src`, following the symlinks in `src`. Unlike with
+// `copyAttributes`, the xattrs that the filesystem of `dst` does not support (e.g., the "user." ones on a tmpfs before
+// Linux 6.6) are skipped.
+func copyRootAttributes(src string, dst string, skipXattrPrefix string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if err = os.Chown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	if err = syscall.Chmod(dst, stat.Mode&07777); err != nil {
+		return &os.PathError{Op: "chmod", Path: dst, Err: err}
+	}
+
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if skipXattrPrefix != "" && strings.HasPrefix(name, skipXattrPrefix) {
+			continue
+		}
+		value, err := getxattr(src, name)
+		if err != nil {
+			return err
+		}
+		err = unix.Lsetxattr(dst, name, value, 0)
+		if err != nil && err != unix.ENOTSUP {
+			return &os.PathError{Op: "lsetxattr", Path: dst, Err: err}
+		}
+	}
+	return nil
+}
+
+// copyTimes sets the access and modification times of `dst` to those of `src` (described by `info`). Symlinks are
+// not followed.
+func copyTimes(dst string, info fs.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	times := []unix.Timespec{unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim))}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: dst, Err: err}
+	}
+	return nil
+}
+
+// copyFileData copies the contents of the regular file `src` to a new file `dst`, which must not exist.
+//
+// If the filesystem supports reflinks (e.g., btrfs or XFS), the copy shares the data blocks with the original until
+// either is modified, so it is made instantly and takes no extra space. Otherwise, the data is copied.
+//
+// Note that hard links, while being just as cheap, are not an option: overlayfs modifies the files in the upperdir
+// in place, so the changes would be seen through all the links.
+func copyFileData(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if unix.IoctlFileClone(int(out.Fd()), int(in.Fd())) == nil {
+		return out.Close()
+	}
+	// Reflinks are not supported (or src and dst are on different filesystems), fall back to copying
+	_, err = io.Copy(out, in)
+	return errors.Join(err, out.Close())
+}
+
+// copyEntry creates `dst` as a copy of `src` (described by `info`), which must be a directory (only the directory
+// itself is created, not its contents), a regular file, a symlink, or a special file. `dst` must not exist.
+//
+// Everything but the timestamps is copied (see `copyAttributes`).
+func copyEntry(src string, dst string, info fs.FileInfo, skipXattrPrefix string) error {
+	var err error
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		err = os.Mkdir(dst, 0o700)
+	case mode.IsRegular():
+		err = copyFileData(src, dst)
+	case mode&fs.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	default:
+		// Device, FIFO, or socket (including overlayfs whiteouts)
+		stat := info.Sys().(*syscall.Stat_t)
+		if err = syscall.Mknod(dst, stat.Mode, int(stat.Rdev)); err != nil {
+			err = &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return copyAttributes(src, dst, info, skipXattrPrefix)
+}
+
+// copyTree recursively copies the directory `src` to `dst`, which must not exist, preserving all the attributes
+// (including overlay xattrs, so an upperdir copy is a valid upperdir). Hard links are not preserved.
+func copyTree(src string, dst string) error {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+
+	// The directories' timestamps are set when their contents are already copied
+	type dirTimes struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []dirTimes
+
+	err := filepath.WalkDir(src, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		target := dst + strings.TrimPrefix(path, src)
+		if err = copyEntry(path, target, info, ""); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, dirTimes{path: target, info: info})
+			return nil
+		}
+		return copyTimes(target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = copyTimes(dirs[i].path, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
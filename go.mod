@@ -3,13 +3,13 @@ module github.com/kolayne/docker-on-top
 go 1.20
 
 require (
+	github.com/docker/go-connections v0.5.0
 	github.com/docker/go-plugins-helpers v0.0.0-20211224144127-6eecb7beb651
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	golang.org/x/sys v0.10.0
 )
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
-	github.com/docker/go-connections v0.5.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
 )
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// A volume created with the `history=N` option keeps its last N states as "generations": every time the last
+// container using the volume unmounts it, the volume's changes are saved (just like a snapshot, see snapshot.go) as
+// the next generation, and the generations beyond the last N are deleted. Generations are numbered starting from 1,
+// the numbers are never reused.
+//
+// Copying the changes might take a while, so it is not done by the unmount request itself, but in the background (see
+// `historySaveLater`). Neither is it done by the next mount request: in the rare case the volume is mounted again
+// before the background saving gets to it, the generation is dropped (see `historyDropPending`).
+
+func (d *DockerOnTop) historydir(volumeName string) string {
+	// See `snapshotsdir`
+	return d.storagedir(volumeName) + "history/"
+}
+
+// historySave saves the volume's changes as a new generation and deletes the oldest generations, so that no more than
+// `keep` are left.
+//
+// The volume must not be mounted (otherwise, the files may be in an inconsistent state) and the lock on activemounts/
+// must be held by the caller.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) historySave(volumeName string, keep int) error {
+	generations, err := d.historyList(volumeName)
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` by `d.historyList`
+		return err
+	}
+
+	next := 1
+	if len(generations) > 0 {
+		next = generationNumber(generations[len(generations)-1]) + 1
+	}
+
+	info, err := d.saveUpper(volumeName, d.historydir(volumeName), strconv.Itoa(next))
+	if err != nil {
+		log.Errorf("Failed to save history generation %d of %s: %v", next, volumeName, err)
+		return internalError("failed to save the history generation", err)
+	}
+	log.Debugf("Saved history generation %d of volume %s (%d bytes)", next, volumeName, info.Size)
+
+	generations = append(generations, info)
+	for len(generations) > keep {
+		if err = os.RemoveAll(d.historydir(volumeName) + generations[0].Name); err != nil {
+			log.Errorf("Failed to delete history generation %s of %s: %v", generations[0].Name, volumeName, err)
+			return internalError("failed to delete an old history generation", err)
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// historypendingmarker is the file that tells that the volume's changes are yet to be saved as a history generation
+// (see `historySaveLater`).
+func (d *DockerOnTop) historypendingmarker(volumeName string) string {
+	return d.dotRootDir + volumeName + "/historypending"
+}
+
+// historySaveLater makes the volume's changes be saved as a new history generation (see `historySave`) without
+// waiting for the copying: the volume is marked as having a pending generation, which is then saved in the background
+// (see `historySaveInBackground`). Until then, the operations that modify the volume's changes save the generation
+// first (see `historyCatchUp`), so it is not mixed with the newer changes. If the plugin is restarted in between, the
+// saving is resumed when it starts (see `NewDockerOnTop`).
+//
+// The volume must not be mounted and the lock on activemounts/ must be held by the caller (the background saving
+// takes it after the caller releases it).
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) historySaveLater(volumeName string) error {
+	if err := os.WriteFile(d.historypendingmarker(volumeName), nil, 0o666); err != nil {
+		log.Errorf("Failed to create the history-pending marker of %s: %v", volumeName, err)
+		return internalError("failed to mark the history generation as pending", err)
+	}
+
+	go d.historySaveInBackground(volumeName)
+	return nil
+}
+
+// historySaveInBackground takes the lock on the volume's activemounts/ and saves the volume's pending history
+// generation, if it is still pending by then (see `historyCatchUp`). Errors are logged.
+func (d *DockerOnTop) historySaveInBackground(volumeName string) {
+	var activemountsdir lockedFile
+	if err := activemountsdir.Open(d.activemountsdir(volumeName)); err != nil {
+		// The error is already logged in lockedFile.go
+		return
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	_ = d.historyCatchUp(volumeName) // The errors are logged, if any
+}
+
+// historyCatchUp saves the volume's pending history generation, if there is one (see `historySaveLater`). Just like
+// when the generation is saved right away, a failure is not retried: the marker is removed anyway.
+//
+// The volume must not be mounted and the lock on activemounts/ must be held by the caller.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) historyCatchUp(volumeName string) error {
+	marker := d.historypendingmarker(volumeName)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Errorf("Failed to check the history-pending marker of %s: %v", volumeName, err)
+		return internalError("failed to check if a history generation is pending", err)
+	}
+
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		err = internalError("failed to retrieve the volume's metadata", err)
+	} else if vol.History > 0 {
+		// The error is already logged and wrapped in `internalError` by `d.historySave`
+		err = d.historySave(volumeName, vol.History)
+	}
+
+	if removeErr := os.Remove(marker); removeErr != nil {
+		log.Errorf("Failed to remove the history-pending marker of %s: %v", volumeName, removeErr)
+		return internalError("failed to remove the history-pending marker", removeErr)
+	}
+	return err
+}
+
+// historyDropPending drops the volume's pending history generation, if there is one (see `historySaveLater`). This is
+// for when the volume is about to be mounted before the generation is saved in the background: saving it then would
+// delay the mount for as long as the copying takes.
+//
+// The lock on activemounts/ must be held by the caller. Errors are logged.
+func (d *DockerOnTop) historyDropPending(volumeName string) {
+	err := os.Remove(d.historypendingmarker(volumeName))
+	if err == nil {
+		log.Warningf("Volume %s is mounted before its previous state was saved to history. That generation is "+
+			"dropped", volumeName)
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to remove the history-pending marker of %s: %v", volumeName, err)
+	}
+}
+
+// historyList lists the history generations of the volume, the oldest first. Errors are logged and wrapped with
+// `internalError`.
+func (d *DockerOnTop) historyList(volumeName string) ([]snapshotInfo, error) {
+	generations, err := listGenerations(d.historydir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to list history generations of %s: %v", volumeName, err)
+		return nil, internalError("failed to list the history generations", err)
+	}
+	return generations, nil
+}
+
+// listGenerations is `listSavedUppers` for numbered generations (of history or trash, see trash.go), which are
+// ordered by number rather than by time, so that the order is right even if the clock has been changed.
+func listGenerations(dir string) ([]snapshotInfo, error) {
+	generations, err := listSavedUppers(dir)
+	sort.SliceStable(generations, func(i, j int) bool {
+		return generationNumber(generations[i]) < generationNumber(generations[j])
+	})
+	return generations, err
+}
+
+// generationNumber returns the number of the generation, or 0 if its name is not a number (which can only be if
+// someone has tampered with the directory).
+func generationNumber(generation snapshotInfo) int {
+	number, _ := strconv.Atoi(generation.Name)
+	return number
+}
+
+// historyRestore replaces the volume's changes with the ones saved in the history generation (the generation is kept).
+//
+// The volume must not be in use, and neither must the volumes stacked on it (see `lockIdleUpper`). The locks are held
+// for the whole operation, so none of them can be mounted in the process.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) historyRestore(volumeName string, generation string) error {
+	release, err := d.lockIdleUpper(volumeName)
+	if err != nil {
+		// The error is already logged by `d.lockIdleUpper`
+		return err
+	}
+	defer release()
+
+	generationUpper := d.historydir(volumeName) + generation + "/upper"
+	if _, err = strconv.Atoi(generation); err != nil {
+		log.Debugf("Invalid history generation %s of %s", generation, volumeName)
+		return fmt.Errorf("invalid history generation %s: should be a number", generation)
+	} else if _, err = os.Stat(generationUpper); os.IsNotExist(err) {
+		log.Debugf("History generation %s of %s does not exist", generation, volumeName)
+		return fmt.Errorf("no such history generation %s", generation)
+	}
+
+	// The current changes might not be saved yet, and going back in history must not lose them. The errors are logged
+	// by `d.historyCatchUp`
+	_ = d.historyCatchUp(volumeName)
+
+	// The error is already logged and wrapped in `internalError` by `d.volumeTreeReplaceUpper`
+	return d.volumeTreeReplaceUpper(volumeName, generationUpper)
+}
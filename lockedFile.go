@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"syscall"
 )
@@ -17,14 +18,27 @@ type lockedFile struct {
 // If an error occurs in either step, it is reported and the internals are cleaned up (i.e. no need for the caller to
 // call `.Close()`), otherwise the object must be `.Close()`d to release the lock and the file descriptor.
 func (lf *lockedFile) Open(path string) error {
+	return lf.open(path, syscall.LOCK_EX)
+}
+
+// TryOpen is like `.Open()`, but does not block: if the file is already locked, `syscall.EWOULDBLOCK` is returned
+// (and not logged).
+func (lf *lockedFile) TryOpen(path string) error {
+	return lf.open(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func (lf *lockedFile) open(path string, how int) error {
 	var err error
 	lf.File, err = os.Open(path)
 	if err != nil {
 		log.Errorf("Failed to Open: %v", err)
 		return internalError("failed to Open inside lockedFile", err)
 	}
-	err = syscall.Flock(int(lf.File.Fd()), syscall.LOCK_EX)
-	if err != nil {
+	err = syscall.Flock(int(lf.File.Fd()), how)
+	if errors.Is(err, syscall.EWOULDBLOCK) && how&syscall.LOCK_NB != 0 {
+		lf.File.Close()
+		return err
+	} else if err != nil {
 		log.Errorf("Failed to get exclusive lock on %s: %v", lf.File.Name(), err)
 		lf.File.Close() // An error is going to be returned, so the caller won't call `.Close()`
 		return internalError("failed to get exclusive Flock", err)
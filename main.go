@@ -1,30 +1,91 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/docker/go-connections/sockets"
 	"github.com/op/go-logging"
 )
 
-func initLogger() *logging.Logger {
-	// Define the log format
-	logFormat := logging.MustStringFormatter(
-		"%{color:reset}%{color}%{time:2006-01-02 15:04:05.000} ▶ %{level:.4s} %{message} [in %{shortfunc}]",
-	)
+// jsonLogFormatter formats log records as JSON objects, one per line
+type jsonLogFormatter struct{}
+
+func (jsonLogFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	record := map[string]string{
+		"time":    r.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		"level":   r.Level.String(),
+		"message": r.Message(),
+	}
+	if pc, _, _, ok := runtime.Caller(calldepth + 1); ok {
+		if f := runtime.FuncForPC(pc); f != nil {
+			record["func"] = strings.TrimPrefix(filepath.Ext(f.Name()), ".")
+		}
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// configureLogger sets up the logging backend with the given log level and format (see `Config`).
+func configureLogger(level string, format string) error {
+	var formatter logging.Formatter
+	switch format {
+	case "color":
+		formatter = logging.MustStringFormatter(
+			"%{color:reset}%{color}%{time:2006-01-02 15:04:05.000} ▶ %{level:.4s} %{message} [in %{shortfunc}]",
+		)
+	case "plain":
+		formatter = logging.MustStringFormatter(
+			"%{time:2006-01-02 15:04:05.000} ▶ %{level:.4s} %{message} [in %{shortfunc}]",
+		)
+	case "json":
+		formatter = jsonLogFormatter{}
+	default:
+		return errors.New("unknown log format " + format)
+	}
+
+	logLevel, err := logging.LogLevel(level)
+	if err != nil {
+		return fmt.Errorf("unknown log level %s", level)
+	}
 
 	// Create a log backend that writes to standard error
 	backend := logging.NewLogBackend(os.Stderr, "", 0)
 
 	// Apply the log format to the backend
-	backendFormatter := logging.NewBackendFormatter(backend, logFormat)
+	backendFormatter := logging.NewBackendFormatter(backend, formatter)
+
+	// Set the backend as the logging backend, with the requested level
+	leveledBackend := logging.AddModuleLevel(backendFormatter)
+	leveledBackend.SetLevel(logLevel, "")
+	logging.SetBackend(leveledBackend)
 
-	// Set the backend as the logging backend
-	logging.SetBackend(backendFormatter)
+	return nil
+}
 
-	// Enable Debug level logs
-	logging.SetLevel(logging.DEBUG, "")
+func initLogger() *logging.Logger {
+	// Until the config is parsed, log everything in the default format
+	defaults := defaultConfig()
+	if err := configureLogger(defaults.LogLevel, defaults.LogFormat); err != nil {
+		panic(err)
+	}
 
 	// Create and return the logger
 	return logging.MustGetLogger("docker-on-top")
@@ -32,18 +93,86 @@ func initLogger() *logging.Logger {
 
 var log *logging.Logger = initLogger()
 
+// shutdownTimeout is how long the daemon waits for the requests being handled when it is asked to terminate.
+// It should be less than systemd's default `TimeoutStopSec` (90s).
+const shutdownTimeout = 30 * time.Second
+
 //go:embed docker-on-top_version.txt
 var Version []byte
 
 func main() {
+	config, args, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Criticalf("Invalid configuration: %v", err)
+		os.Exit(2)
+	}
+	if err = configureLogger(config.LogLevel, config.LogFormat); err != nil {
+		log.Criticalf("Invalid configuration: %v", err)
+		os.Exit(2)
+	}
+
+	if len(args) > 0 {
+		if err = runAdminCommand(config, args); err != nil {
+			fmt.Fprintf(os.Stderr, "docker-on-top: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Infof("Starting docker-on-top v%s", string(Version))
 
-	dotRootDir := "/var/lib/docker-on-top/"
-	socketPath := "/run/docker/plugins/docker-on-top.sock"
+	socketPath := config.socketPath()
+	socketGid, err := config.socketGid()
+	if err != nil {
+		log.Criticalf("Failed to resolve the socket group %s: %v", config.SocketGroup, err)
+		os.Exit(1)
+	}
+
+	driver := MustNewDockerOnTop(config.DotRootDir, config.Pools, config.DefaultPool)
+	server := &http.Server{Handler: newPluginHandler(driver)}
+
+	if err = os.MkdirAll(filepath.Dir(socketPath), 0o755); err != nil {
+		log.Criticalf("Failed to create the socket directory: %v", err)
+		os.Exit(1)
+	}
+	// Note: the socket file is removed when the listener is closed
+	listener, err := sockets.NewUnixSocket(socketPath, socketGid)
+	if err != nil {
+		log.Criticalf("Failed to listen at %s: %v", socketPath, err)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	log.Infof("Serving driver %s at %s", config.DriverName, socketPath)
 
-	handler := volume.NewHandler(MustNewDockerOnTop(dotRootDir))
-	log.Infof("Serving at %s", socketPath)
-	log.Critical(handler.ServeUnix(socketPath, 0))
+	select {
+	case err = <-serveErr:
+		log.Criticalf("Stopped serving: %v", err)
+		_ = listener.Close()
+		os.Exit(1)
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+	}
 
-	// TODO: in case of abrupt termination, delete the socket file
+	// Stop accepting new connections, then wait for the requests that are being handled, until their responses are
+	// sent (otherwise, e.g., a volume that is mounted might be reported to docker as failed to mount)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if removeErr := os.Remove(socketPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Errorf("Failed to remove the socket: %v", removeErr)
+	}
+	if err != nil {
+		log.Criticalf("Failed to shut down gracefully: requests still running after %v: %v", shutdownTimeout, err)
+		os.Exit(1)
+	}
+	log.Info("Shut down gracefully")
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The overlay is mounted with the new mount API (fsopen/fsconfig/fsmount/move_mount), which allows to pass every
+// directory as a separate parameter, so the paths may contain any characters (in particular, the commas and colons,
+// which separate the options of the classic mount(2)) and there is no limit on the total length of the options.
+// Passing each lower layer separately ("lowerdir+") requires Linux 6.8; on older kernels, the classic mount(2) is
+// used, with the special characters escaped.
+
+// Not available in golang.org/x/sys v0.10.0
+const (
+	fsconfigSetFlag   = 0
+	fsconfigSetString = 1
+	fsconfigCmdCreate = 6
+)
+
+// overlayMountFlags are the mount flags that can be requested for a volume (each with a boolean volume option named
+// the same), with their values for fsmount(2) and for mount(2).
+var overlayMountFlags = map[string]struct {
+	attr  int
+	flags uintptr
+}{
+	"ro":      {unix.MOUNT_ATTR_RDONLY, syscall.MS_RDONLY},
+	"nosuid":  {unix.MOUNT_ATTR_NOSUID, syscall.MS_NOSUID},
+	"nodev":   {unix.MOUNT_ATTR_NODEV, syscall.MS_NODEV},
+	"noexec":  {unix.MOUNT_ATTR_NOEXEC, syscall.MS_NOEXEC},
+	"noatime": {unix.MOUNT_ATTR_NOATIME, syscall.MS_NOATIME},
+}
+
+// overlayMountFlagNames returns the names of `overlayMountFlags`, sorted.
+func overlayMountFlagNames() []string {
+	names := make([]string, 0, len(overlayMountFlags))
+	for name := range overlayMountFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// overlayOptions are the overlayfs options that can be set for a volume (with the volume options named the same),
+// with their allowed values. The options with no values are flags (set with a boolean volume option). See
+// https://docs.kernel.org/filesystems/overlayfs.html for their meaning.
+var overlayOptions = map[string][]string{
+	"redirect_dir": {"on", "follow", "nofollow", "off"},
+	"metacopy":     {"on", "off"},
+	"index":        {"on", "off"},
+	"xino":         {"on", "off", "auto"},
+	"userxattr":    nil,
+}
+
+// sortedKeys returns the keys of the map, sorted.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mountOverlay mounts an overlay with the given layers (`lowers` being the topmost first) at `target`. `source` is
+// the name of the mount, as shown in /proc/mounts. `flags` are the names of `overlayMountFlags` to mount with, and
+// `options` are the `overlayOptions` (with empty values for flags).
+func mountOverlay(source string, target string, lowers []string, upperdir string, workdir string,
+	flags []string, options map[string]string) error {
+
+	var attr int
+	var mountFlags uintptr
+	for _, flag := range flags {
+		attr |= overlayMountFlags[flag].attr
+		mountFlags |= overlayMountFlags[flag].flags
+	}
+
+	lowersAccepted, newAPIErr := mountOverlayNewAPI(source, target, lowers, upperdir, workdir, attr, options)
+	err := newAPIErr
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINVAL) {
+		// ENOSYS: the new mount API is unsupported. EINVAL: the "lowerdir+" parameter is unsupported. Also,
+		// EINVAL may mean the parameters are wrong, in which case the classic mount(2) will fail as well
+		log.Debugf("Failed to mount %s with the new mount API (%v). Falling back to mount(2)", target, err)
+		data := "lowerdir=" + escapeLowerdirs(lowers) + ",upperdir=" + escapeOverlayOption(upperdir) +
+			",workdir=" + escapeOverlayOption(workdir)
+		for _, name := range sortedKeys(options) {
+			if options[name] == "" {
+				data += "," + name
+			} else {
+				data += "," + name + "=" + options[name]
+			}
+		}
+		err = syscall.Mount(source, target, "overlay", mountFlags, data)
+		if errors.Is(err, syscall.EINVAL) && lowersAccepted {
+			// The new API is supported, so its error is the same one, but it tells which parameter (or step) is
+			// wrong, while mount(2) only returns EINVAL
+			err = newAPIErr
+		} else if err != nil {
+			err = &os.PathError{Op: "mount", Path: target, Err: err}
+		}
+	}
+	return err
+}
+
+// mountOverlayNewAPI is `mountOverlay` with the new mount API (fsopen(2) and friends). `lowersAccepted` tells if the
+// kernel has accepted the "lowerdir+" parameters, which means that the new API is fully supported, so an EINVAL after
+// that is caused by the parameters themselves.
+func mountOverlayNewAPI(source string, target string, lowers []string, upperdir string, workdir string,
+	attr int, options map[string]string) (lowersAccepted bool, err error) {
+	fsfd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return false, &os.PathError{Op: "fsopen", Path: "overlay", Err: err}
+	}
+	defer unix.Close(fsfd)
+
+	params := [][2]string{{"source", source}}
+	for _, lower := range lowers {
+		params = append(params, [2]string{"lowerdir+", lower})
+	}
+	params = append(params, [2]string{"upperdir", upperdir}, [2]string{"workdir", workdir})
+	for _, name := range sortedKeys(options) {
+		params = append(params, [2]string{name, options[name]})
+	}
+	for i, param := range params {
+		cmd := fsconfigSetString
+		if param[1] == "" {
+			cmd = fsconfigSetFlag
+		}
+		if err = fsconfig(fsfd, cmd, param[0], param[1]); err != nil {
+			return lowersAccepted, &os.PathError{Op: "fsconfig " + param[0], Path: param[1], Err: err}
+		}
+		lowersAccepted = i >= len(lowers)
+	}
+	if err = fsconfig(fsfd, fsconfigCmdCreate, "", ""); err != nil {
+		return true, &os.PathError{Op: "fsconfig create", Path: target, Err: err}
+	}
+
+	mntfd, err := unix.Fsmount(fsfd, unix.FSMOUNT_CLOEXEC, attr)
+	if err != nil {
+		return true, &os.PathError{Op: "fsmount", Path: target, Err: err}
+	}
+	defer unix.Close(mntfd)
+
+	err = unix.MoveMount(mntfd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH)
+	if err != nil {
+		return true, &os.PathError{Op: "move_mount", Path: target, Err: err}
+	}
+	return true, nil
+}
+
+// fsconfig calls fsconfig(2) with a string value. Empty key or value are passed as NULL.
+func fsconfig(fd int, cmd int, key string, value string) error {
+	var keyp, valuep *byte
+	var err error
+	if key != "" {
+		if keyp, err = unix.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+	if value != "" {
+		if valuep, err = unix.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), uintptr(cmd), uintptr(unsafe.Pointer(keyp)),
+		uintptr(unsafe.Pointer(valuep)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// escapeOverlayOption escapes the characters that have special meaning in the overlay options of mount(2).
+func escapeOverlayOption(path string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`).Replace(path)
+}
+
+// escapeLowerdirs makes the value of the "lowerdir" option of mount(2) out of the lower layers.
+func escapeLowerdirs(lowers []string) string {
+	escaped := make([]string, len(lowers))
+	for i, lower := range lowers {
+		escaped[i] = escapeOverlayOption(lower)
+	}
+	return strings.Join(escaped, ":")
+}
+
+// splitBaseDirs splits the value of the `base` volume option into the base directories. Just like in the overlay's
+// "lowerdir" option, the directories are separated by colons, and a backslash escapes the next character.
+func splitBaseDirs(value string) []string {
+	var dirs []string
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			i++
+			current.WriteByte(value[i])
+		case value[i] == ':':
+			dirs = append(dirs, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	return append(dirs, current.String())
+}
+
+// joinBaseDirs is the inverse of `splitBaseDirs`.
+func joinBaseDirs(dirs []string) string {
+	escaped := make([]string, len(dirs))
+	for i, dir := range dirs {
+		escaped[i] = strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(dir)
+	}
+	return strings.Join(escaped, ":")
+}
+
+// probeMount checks that the volume's overlay can be mounted by mounting and immediately unmounting it. The overlay is
+// mounted with a throwaway upperdir and workdir (see `probedir`), so that neither the mount (e.g., the "index" option
+// stamps the upperdir with xattrs) nor the preparations for it (see `volumeTreePreMount`) affect the volume.
+//
+// Errors are logged. If the overlay cannot be mounted, the error (which is likely caused by the volume's options) is
+// returned as is, other errors are wrapped with `internalError`.
+func (d *DockerOnTop) probeMount(volumeName string) error {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to retrieve the volume's metadata", err)
+	}
+	lowers, err := d.volumeLowerDirs(volumeName)
+	if err != nil {
+		log.Errorf("Failed to resolve the lower layers of volume %s: %v", volumeName, err)
+		return internalError("failed to resolve the base volume", err)
+	}
+
+	probedir := d.probedir(volumeName)
+	mountpoint, upperdir, workdir := probedir+"mountpoint", probedir+"upper", probedir+"workdir"
+	// In case a previous probe was interrupted. The errors are checked by `os.RemoveAll`
+	_ = syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+	err = os.RemoveAll(probedir)
+	if err == nil {
+		err = errors.Join(os.Mkdir(probedir, 0o700), os.Mkdir(mountpoint, 0o700), os.Mkdir(upperdir, 0o700),
+			os.Mkdir(workdir, 0o700))
+	}
+	if err != nil {
+		log.Errorf("Failed to create the directories for the probe mount of %s: %v", volumeName, err)
+		_ = os.RemoveAll(probedir)
+		return internalError("failed to prepare the probe mount", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(probedir); err != nil {
+			log.Warningf("Failed to remove the directories of the probe mount of %s: %v", volumeName, err)
+		}
+	}()
+
+	err = mountOverlay("docker-on-top_"+volumeName, mountpoint, lowers, upperdir, workdir, vol.MountFlags,
+		vol.OverlayOptions)
+	if err != nil {
+		log.Debugf("Probe mount of volume %s failed: %v", volumeName, err)
+		return fmt.Errorf("the overlay cannot be mounted with the requested options "+
+			"(are they supported by the kernel?): %w", err)
+	}
+
+	if err = syscall.Unmount(mountpoint, 0); err != nil {
+		log.Errorf("Failed to unmount %s after the probe mount: %v", mountpoint, err)
+		return internalError("failed to unmount the probe mount", err)
+	}
+	return nil
+}
+
+// probedir is the directory with the throwaway mountpoint, upperdir and workdir of `probeMount`. It is in the volume's
+// storage directory, so that the upperdir is on the same filesystem as the volume's one (unless the volume has a
+// quota).
+func (d *DockerOnTop) probedir(volumeName string) string {
+	return d.storagedir(volumeName) + "probe/"
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+/*
+Overlayfs marks some of the changes in the upperdir in a special way. The helpers in this file recognize these marks,
+so that the upperdir (or a copy of it) can be interpreted without mounting the overlay. Of those, the following are
+relevant to docker-on-top:
+	- A whiteout (a character device with device number 0/0) marks a file or directory that is deleted.
+	- An opaque directory (one with the "overlay.opaque" xattr set to "y") hides the contents of the lower layers.
+	- A redirect (the "overlay.redirect" xattr of a directory) marks a directory that has been renamed: the
+		directory's lower contents are taken from the path the xattr points to (only with `redirect_dir=on`).
+	- A metacopy (the "overlay.metacopy" xattr of a regular file) marks a file whose metadata only has been copied up,
+		while the data is still in the lower layers (only with `metacopy=on`).
+
+The overlay xattrs are in the "trusted." namespace, or in the "user." namespace if the overlay is mounted with
+the `userxattr` option (see `overlayXattrPrefix`). Only the namespace the overlay is mounted with is special: the
+xattrs in the other one are ordinary xattrs, which the containers can set freely, so they must never be interpreted as
+the marks. Overlayfs also keeps some other xattrs in its namespace for internal bookkeeping, which are irrelevant to
+the content of the volume. See https://docs.kernel.org/filesystems/overlayfs.html for details.
+*/
+
+// overlayXattrPrefix returns the prefix of the overlay xattrs of an overlay mounted with the overlayfs `options` (see
+// `VolumeInfo.OverlayOptions`).
+func overlayXattrPrefix(options map[string]string) string {
+	if _, ok := options["userxattr"]; ok {
+		return "user.overlay."
+	}
+	return "trusted.overlay."
+}
+
+// getxattr returns the value of the xattr of the file at `path` (following symlinks) or `nil` if it is not set.
+func getxattr(path string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return value[:size], nil
+}
+
+// getOverlayXattr returns the value of the overlay xattr `name` (without the prefix, e.g., "opaque") of the file at
+// `path`, or `nil` if it is not set. `prefix` is the `overlayXattrPrefix` of the overlay. Symlinks are never checked,
+// as overlayfs does not mark them.
+func getOverlayXattr(path string, info fs.FileInfo, prefix string, name string) ([]byte, error) {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil, nil
+	}
+	return getxattr(path, prefix+name)
+}
+
+// isWhiteout tells if the file is an overlayfs whiteout.
+func isWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// isOpaqueDir tells if the file at `path` is an opaque directory. `prefix` is the `overlayXattrPrefix` of the overlay.
+func isOpaqueDir(path string, info fs.FileInfo, prefix string) (bool, error) {
+	if !info.IsDir() {
+		return false, nil
+	}
+	value, err := getOverlayXattr(path, info, prefix, "opaque")
+	return string(value) == "y", err
+}
+
+// lowerLookup finds the file at `relPath` (relative to the overlay root, starting with '/') in the overlay's lower
+// layers (`lowers`, the topmost first), as it would be seen in the overlay if there was no upperdir. The path to
+// the file in the topmost layer that has it and the file's `os.Lstat` are returned. If the file does not exist in
+// the lower layers, `nil` info is returned with no error.
+//
+// Whiteouts and opaque directories in the lower layers are respected, but redirects are not. `prefix` is the
+// `overlayXattrPrefix` of the overlay.
+func lowerLookup(lowers []string, relPath string, prefix string) (string, fs.FileInfo, error) {
+	for _, lower := range lowers {
+		info, err := os.Lstat(lower + relPath)
+		if err == nil {
+			if isWhiteout(info) {
+				return "", nil, nil
+			}
+			return lower + relPath, info, nil
+		} else if !os.IsNotExist(err) && !isNotDirError(err) {
+			return "", nil, err
+		}
+
+		// The file is absent in this layer. It is visible from the layers below unless hidden by an ancestor in
+		// this layer (a whiteout, a non-directory, or an opaque directory)
+		hidden, err := isHiddenBelow(lower, relPath, prefix)
+		if hidden || err != nil {
+			return "", nil, err
+		}
+	}
+	return "", nil, nil
+}
+
+// isHiddenBelow tells if the layers below `layer` are hidden at `relPath` by some ancestor of `relPath` in `layer`.
+func isHiddenBelow(layer string, relPath string, prefix string) (bool, error) {
+	for i := 1; i < len(relPath); i++ {
+		if relPath[i] != '/' {
+			continue
+		}
+		ancestor := layer + relPath[:i]
+		info, err := os.Lstat(ancestor)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			return true, nil
+		}
+		if opaque, err := isOpaqueDir(ancestor, info, prefix); opaque || err != nil {
+			return opaque, err
+		}
+	}
+	return false, nil
+}
+
+// isNotDirError tells if the error is caused by a non-directory being a part of a path.
+func isNotDirError(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.ENOTDIR
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// newPluginHandler returns the handler of the volume plugin protocol for the driver. It serves the same endpoints as
+// go-plugins-helpers' `volume.Handler`, which, however, can only serve a listener on its own and not be shut down
+// gracefully. This one is an `http.Handler`, so the daemon serves it with its own `http.Server` (see `main`), whose
+// `Shutdown` waits for the responses of the requests being handled to be sent.
+func newPluginHandler(driver volume.Driver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+		fmt.Fprintln(w, `{"Implements": ["VolumeDriver"]}`)
+	})
+
+	handlePluginRequest(mux, "/VolumeDriver.Create", func(req *volume.CreateRequest) (interface{}, error) {
+		return struct{}{}, driver.Create(req)
+	})
+	handlePluginRequest(mux, "/VolumeDriver.Remove", func(req *volume.RemoveRequest) (interface{}, error) {
+		return struct{}{}, driver.Remove(req)
+	})
+	handlePluginRequest(mux, "/VolumeDriver.Mount", func(req *volume.MountRequest) (interface{}, error) {
+		return driver.Mount(req)
+	})
+	handlePluginRequest(mux, "/VolumeDriver.Unmount", func(req *volume.UnmountRequest) (interface{}, error) {
+		return struct{}{}, driver.Unmount(req)
+	})
+	handlePluginRequest(mux, "/VolumeDriver.Path", func(req *volume.PathRequest) (interface{}, error) {
+		return driver.Path(req)
+	})
+	handlePluginRequest(mux, "/VolumeDriver.Get", func(req *volume.GetRequest) (interface{}, error) {
+		return driver.Get(req)
+	})
+
+	// These have no request body
+	mux.HandleFunc("/VolumeDriver.List", func(w http.ResponseWriter, r *http.Request) {
+		res, err := driver.List()
+		if err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(err.Error()), true)
+			return
+		}
+		sdk.EncodeResponse(w, res, false)
+	})
+	mux.HandleFunc("/VolumeDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
+		sdk.EncodeResponse(w, driver.Capabilities(), false)
+	})
+
+	return mux
+}
+
+// handlePluginRequest registers the handler of the endpoint at `path`, which decodes the request body into `Req`,
+// calls `fn` with it, and encodes either the response or the error.
+func handlePluginRequest[Req any](mux *http.ServeMux, path string, fn func(*Req) (interface{}, error)) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		req := new(Req)
+		if err := sdk.DecodeRequest(w, r, req); err != nil {
+			return // The error response is already sent
+		}
+		res, err := fn(req)
+		if err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(err.Error()), true)
+			return
+		}
+		sdk.EncodeResponse(w, res, false)
+	})
+}
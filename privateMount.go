@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// A volume created with `-o sharing=private` is not shared between containers: every mount ID gets its own overlay,
+// with its own upperdir, workdir and mountpoint (in private/<mount ID>/ inside the volume's storage directory, see
+// `storagedir`, as the private upperdirs hold the containers' changes just like the volume's own one), on top of
+// the volume's upperdir and lower layers. Thus, containers see the volume's (or its base's) contents but not each
+// other's changes. A private layer is created when the mount ID is first mounted and is discarded when it is unmounted
+// (that is, when its active mount file is removed).
+//
+// The volume's own upperdir is never mounted as an upperdir for a private volume, so it can still be prepared (e.g.,
+// with `clonefrom` or `snapshot restore`) for all the containers to start from.
+
+func (d *DockerOnTop) privatemountsdir(volumeName string) string {
+	return d.storagedir(volumeName) + "private/"
+}
+
+func (d *DockerOnTop) privatedir(volumeName string, mountId string) string {
+	return d.privatemountsdir(volumeName) + mountId + "/"
+}
+
+func (d *DockerOnTop) privateMountpoint(volumeName string, mountId string) string {
+	return d.privatedir(volumeName, mountId) + "mountpoint/"
+}
+
+// activatePrivateMount mounts the private overlay of the mount ID, unless it is already mounted (that is, the mount ID
+// is already active, see `activeMount`).
+//
+// The caller is expected to hold the lock on the volume's activemounts/ directory. Errors are logged, the ones that
+// are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) activatePrivateMount(volumeName string, mountId string, vol VolumeInfo) error {
+	if _, err := os.Stat(d.activemountsdir(volumeName) + mountId); err == nil {
+		log.Debugf("Volume %s is already mounted for %s. Indicating success without remounting", volumeName, mountId)
+		return nil
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to stat active mount file of %s: %v", mountId, err)
+		return internalError("failed to check the active mount file", err)
+	}
+
+	lowers, err := d.volumeLowerDirs(volumeName)
+	if err != nil {
+		log.Errorf("Failed to resolve the lower layers of volume %s: %v", volumeName, err)
+		return internalError("failed to resolve the base volume", err)
+	}
+	lowers = append([]string{d.upperdir(volumeName)}, lowers...)
+
+	// Whatever is left from a previous mount with the same ID (e.g., if the plugin crashed) is not needed
+	if err = d.removePrivateMount(volumeName, mountId, syscall.MNT_DETACH); err != nil {
+		// The error is already logged and wrapped in `internalError` by `d.removePrivateMount`
+		return err
+	}
+	privatedir := d.privatedir(volumeName, mountId)
+	for _, dir := range []string{"upper", "workdir", "mountpoint"} {
+		err = os.MkdirAll(privatedir+dir, os.ModePerm)
+		if err == nil && dir == "upper" {
+			// The private overlay's root must look like the volume's one (see `volumeTreeCopyBaseRoot`)
+			err = copyRootAttributes(lowers[0], privatedir+dir, overlayXattrPrefix(vol.OverlayOptions))
+		}
+		if err != nil {
+			log.Errorf("Failed to create private directories for %s of %s: %v", mountId, volumeName, err)
+			_ = os.RemoveAll(privatedir)
+			return internalError("failed to prepare internal directories", err)
+		}
+	}
+
+	err = mountOverlay("docker-on-top_"+volumeName, d.privateMountpoint(volumeName, mountId), lowers,
+		privatedir+"upper", privatedir+"workdir", vol.MountFlags, vol.OverlayOptions)
+	if err != nil {
+		_ = os.RemoveAll(privatedir)
+	}
+	if os.IsNotExist(err) {
+		log.Errorf("Failed to mount private overlay for volume %s because something does not exist: %v",
+			volumeName, err)
+		return errors.New("failed to mount volume: something is missing (does the base directory exist?)")
+	} else if err != nil {
+		log.Errorf("Failed to mount private overlay for volume %s: %v", volumeName, err)
+		return internalError("failed to mount overlay", err)
+	}
+
+	log.Debugf("Mounted volume %s for %s at %s", volumeName, mountId, d.privateMountpoint(volumeName, mountId))
+	return nil
+}
+
+// removePrivateMount unmounts the private overlay of the mount ID (with the `unmountFlags`), if it is mounted, and
+// removes its directory, discarding the changes. If the overlay is not mounted, it is not considered an error.
+//
+// Errors are logged and wrapped with `internalError`.
+func (d *DockerOnTop) removePrivateMount(volumeName string, mountId string, unmountFlags int) error {
+	mountpoint := d.privateMountpoint(volumeName, mountId)
+	err := syscall.Unmount(mountpoint, unmountFlags)
+	if err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		// EINVAL means it's not mounted
+		log.Errorf("Failed to unmount %s: %v", mountpoint, err)
+		return internalError("failed to unmount the private overlay", err)
+	}
+	if err = os.RemoveAll(d.privatedir(volumeName, mountId)); err != nil {
+		log.Errorf("Failed to RemoveAll private directory of %s of %s: %v", mountId, volumeName, err)
+		return internalError("failed to discard the private changes", err)
+	}
+	return nil
+}
+
+// privateMountIds lists the mount IDs that have private directories. If there are none, nothing is returned. Errors
+// are returned but not logged.
+func (d *DockerOnTop) privateMountIds(volumeName string) ([]string, error) {
+	entries, err := os.ReadDir(d.privatemountsdir(volumeName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.Name())
+	}
+	return ids, nil
+}
+
+// privateMountsOnBootReset removes the private directories of the volume (see `volumeTreeOnBootReset`) and tells if
+// there were any. If any private overlay is still mounted, an error satisfying `errors.Is(err, syscall.EBUSY)` is
+// returned, and the directories are left in place. Errors are returned but not logged.
+func (d *DockerOnTop) privateMountsOnBootReset(volumeName string) (bool, error) {
+	ids, err := d.privateMountIds(volumeName)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		err = os.Remove(d.privateMountpoint(volumeName, id))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return len(ids) > 0, os.RemoveAll(d.privatemountsdir(volumeName))
+}
+
+// volumeMounted tells if any overlay of the volume is mounted: the shared one or a private one.
+func (d *DockerOnTop) volumeMounted(volumeName string) (bool, error) {
+	mounted, err := isMountpoint(d.mountpointdir(volumeName))
+	if err != nil || mounted {
+		return mounted, err
+	}
+	ids, err := d.privateMountIds(volumeName)
+	for _, id := range ids {
+		if mounted, err = isMountpoint(d.privateMountpoint(volumeName, id)); err != nil || mounted {
+			return mounted, err
+		}
+	}
+	return false, err
+}
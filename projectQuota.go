@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A volume created with `-o quota=<size> -o quotamode=project` is limited with the project quotas of the dot root
+// directory's filesystem (XFS mounted with "prjquota", or ext4 with the "project" and "quota" features mounted with
+// "prjquota") instead of a quota image (see quota.go): the volume's upperdir gets its own project ID, which is
+// inherited by everything created inside it, and the block (and, optionally, inode) limits are set for that project.
+// Unlike the quota image, the limits can be changed later (see `DockerOnTop.projectQuotaSetLimits`).
+//
+// Whenever the upperdir is recreated (e.g., when the volume is reset or a snapshot is restored), the project ID is set
+// on it again (see `DockerOnTop.volumeTreeInitUpper`). So it is on the workdir, whenever it is created: overlayfs
+// prepares the new files there and then renames them into the upperdir, and XFS and ext4 refuse to rename a file into
+// a directory that has a different project ID and the inherit flag.
+
+const (
+	quotaModeImage   = "image"
+	quotaModeProject = "project"
+)
+
+// projectQuotaFirstID is the smallest project ID assigned to volumes. Smaller IDs are left for the administrator
+const projectQuotaFirstID = 1 << 20
+
+// Not available in golang.org/x/sys v0.10.0. See linux/fs.h and linux/quota.h
+const (
+	fsIocFsgetxattr    = 0x801c581f
+	fsIocFssetxattr    = 0x401c5820
+	fsXflagProjinherit = 0x200
+	qGetinfo           = 0x800005
+	qGetquota          = 0x800007
+	qSetquota          = 0x800008
+	prjquota           = 2
+	qifBlimits         = 1
+	qifIlimits         = 4
+	qifDqblksize       = 1024
+)
+
+// fsxattr is `struct fsxattr` of linux/fs.h
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	Pad        [8]byte
+}
+
+// ifDqblk is `struct if_dqblk` of linux/quota.h
+type ifDqblk struct {
+	Bhardlimit uint64
+	Bsoftlimit uint64
+	Curspace   uint64
+	Ihardlimit uint64
+	Isoftlimit uint64
+	Curinodes  uint64
+	Btime      uint64
+	Itime      uint64
+	Valid      uint32
+}
+
+// ifDqinfo is `struct if_dqinfo` of linux/quota.h
+type ifDqinfo struct {
+	Bgrace uint64
+	Igrace uint64
+	Flags  uint32
+	Valid  uint32
+}
+
+// errProjectQuotaUnsupported is returned when the filesystem does not support project quotas
+var errProjectQuotaUnsupported = errors.New("the filesystem of the dot root directory does not support project " +
+	"quotas (XFS or ext4 with project quotas enabled and mounted with `prjquota`, and Linux 5.14+ are required)")
+
+// volumeTreeCreateProjectQuota sets the volume's project ID on its upperdir and sets the project's limits: `bytes`
+// and `inodes` (0 for no limit). If the filesystem does not support project quotas, an error wrapping
+// `errProjectQuotaUnsupported` is returned.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeCreateProjectQuota(volumeName string, projectID uint32, bytes int64,
+	inodes uint64) error {
+	var info ifDqinfo
+	err := quotactl(d.upperdir(volumeName), qGetinfo, 0, unsafe.Pointer(&info))
+	if err == nil {
+		err = setProjectID(d.upperdir(volumeName), projectID)
+	}
+	if isUnsupportedErrno(err) {
+		log.Debugf("Project quotas are not supported for volume %s: %v", volumeName, err)
+		return fmt.Errorf("%w: %v", errProjectQuotaUnsupported, err)
+	} else if err != nil {
+		log.Errorf("Failed to set the project ID of volume %s: %v", volumeName, err)
+		return internalError("failed to set the project ID", err)
+	}
+	// The error is already logged and wrapped in `internalError` by `d.projectQuotaSetLimits`
+	return d.projectQuotaSetLimits(volumeName, projectID, bytes, inodes)
+}
+
+// projectQuotaSetLimits sets the limits of the volume's project: `bytes` and `inodes` (0 for no limit).
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) projectQuotaSetLimits(volumeName string, projectID uint32, bytes int64, inodes uint64) error {
+	limits := ifDqblk{
+		Bhardlimit: (uint64(bytes) + qifDqblksize - 1) / qifDqblksize,
+		Ihardlimit: inodes,
+		Valid:      qifBlimits | qifIlimits,
+	}
+	err := quotactl(d.upperdir(volumeName), qSetquota, projectID, unsafe.Pointer(&limits))
+	if err != nil {
+		log.Errorf("Failed to set the project quota of volume %s: %v", volumeName, err)
+		return internalError("failed to set the project quota", err)
+	}
+	return nil
+}
+
+// projectQuotaUsage returns the space (in bytes) and the number of inodes used by the volume's project. Errors are
+// returned but not logged.
+func (d *DockerOnTop) projectQuotaUsage(volumeName string, projectID uint32) (int64, uint64, error) {
+	var usage ifDqblk
+	err := quotactl(d.upperdir(volumeName), qGetquota, projectID, unsafe.Pointer(&usage))
+	return int64(usage.Curspace), usage.Curinodes, err
+}
+
+// nextProjectID returns the project ID for a new volume: the one after the largest project ID of the existing volumes.
+// The lock on the dot root directory must be held until the new volume's metadata is written. Errors are returned but
+// not logged.
+func (d *DockerOnTop) nextProjectID() (uint32, error) {
+	entries, err := os.ReadDir(d.dotRootDir)
+	if err != nil {
+		return 0, err
+	}
+	next := uint32(projectQuotaFirstID)
+	for _, entry := range entries {
+		vol, err := d.getVolumeInfo(entry.Name())
+		if err == nil && vol.ProjectID >= next {
+			next = vol.ProjectID + 1
+		}
+	}
+	return next, nil
+}
+
+// isUnsupportedErrno tells if the error from a quota-related syscall means that the filesystem (or the kernel) does
+// not support quotas or that they are not enabled.
+func isUnsupportedErrno(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) ||
+		errors.Is(err, unix.ESRCH) || errors.Is(err, unix.EINVAL)
+}
+
+// quotactl calls quotactl_fd(2) with the project quota type for the filesystem that `path` is on.
+func quotactl(path string, cmd uint32, id uint32, addr unsafe.Pointer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd = cmd<<8 | prjquota // QCMD
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), uintptr(cmd), uintptr(id), uintptr(addr), 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "quotactl", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// setProjectID sets the project ID of the file (and, for directories, the flag to inherit it) and, if `path` is a
+// directory, of everything inside it.
+func setProjectID(path string, projectID uint32) error {
+	return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			// The ioctls cannot be performed on symlinks and special files (which take no blocks anyway)
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var attr fsxattr
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsgetxattr, uintptr(unsafe.Pointer(&attr)))
+		if errno == 0 {
+			attr.Projid = projectID
+			if entry.IsDir() {
+				attr.Xflags |= fsXflagProjinherit
+			}
+			_, _, errno = unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFssetxattr, uintptr(unsafe.Pointer(&attr)))
+		}
+		if errno != 0 {
+			return &os.PathError{Op: "set project ID", Path: path, Err: errno}
+		}
+		return nil
+	})
+}
+
+// projectQuotaUpdate changes the limits of the volume's project quota: `bytes` (which must not be 0, the quota cannot
+// be removed) and `inodes` (0 for no limit). The volume may be in use.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) projectQuotaUpdate(volumeName string, bytes int64, inodes uint64) error {
+	if bytes <= 0 {
+		log.Debugf("Invalid quota %d for volume %s", bytes, volumeName)
+		return errors.New("the quota must be greater than 0 (a volume's quota cannot be removed)")
+	}
+
+	// Taking the locks, so that the volume's metadata is not modified concurrently (the lock on activemounts/) and
+	// `nextProjectID` sees the project ID (the lock on the dot root directory, taken in the same order as in
+	// `DockerOnTop.Create`)
+	var activemountsdir, dotRootDir lockedFile
+	err := activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+	if err = dotRootDir.Open(d.dotRootDir); err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return err
+	}
+	defer dotRootDir.Close() // There's nothing I can do about the error if it occurs
+
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to retrieve the volume's metadata", err)
+	} else if vol.QuotaMode != quotaModeProject {
+		log.Debugf("Volume %s has no project quota. Not changing the quota", volumeName)
+		return fmt.Errorf("volume %s has no project quota (only project quotas can be changed)", volumeName)
+	}
+
+	if err = d.projectQuotaSetLimits(volumeName, vol.ProjectID, bytes, inodes); err != nil {
+		// The error is already logged and wrapped in `internalError` by `d.projectQuotaSetLimits`
+		return err
+	}
+	vol.Quota, vol.QuotaInodes = bytes, inodes
+	if err = d.writeVolumeInfo(volumeName, vol); err != nil {
+		log.Errorf("Failed to write metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to store the new quota (it is set, but will be reported wrong)", err)
+	}
+	return nil
+}
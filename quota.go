@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A volume created with `-o quota=<size>` keeps its changes in an ext4 filesystem image of that size (a sparse file,
+// upper.img in the volume's storage directory, see `DockerOnTop.storagedir`), so the containers cannot write more than
+// that into the volume, whatever filesystem the dot root directory is on. The image is loop-mounted at quota/, which
+// then holds upper/ and workdir/ instead of the volume's storage directory (see `upperrootdir`).
+//
+// The changes must be accessible even when the volume is not mounted (e.g., for the admin commands or for the volumes
+// stacked on it), so the image stays mounted as long as the plugin runs: it is mounted when the volume is created, when
+// the plugin starts, and before the overlay is mounted, in case it is not mounted for some reason. It is unmounted when
+// the volume is removed.
+
+// quotaMinSize is the smallest quota allowed: smaller ext4 filesystems have hardly any space for the files
+const quotaMinSize = 16 << 20
+
+// byteSizeFormat is the format of the `quota` option: a number of bytes with an optional k, m, g, or t suffix
+var byteSizeFormat = regexp.MustCompile("^([0-9]+)([kKmMgGtT])?$")
+
+func (d *DockerOnTop) quotaimg(volumeName string) string {
+	return d.storagedir(volumeName) + "upper.img"
+}
+
+func (d *DockerOnTop) quotadir(volumeName string) string {
+	return d.dotRootDir + volumeName + "/quota/"
+}
+
+// upperrootdir returns the directory that contains the volume's upper/ and workdir/: quota/ for volumes with a quota,
+// or the storage directory otherwise (see `storagedir`).
+func (d *DockerOnTop) upperrootdir(volumeName string) string {
+	if _, err := os.Stat(d.quotaimg(volumeName)); err == nil {
+		return d.quotadir(volumeName)
+	}
+	return d.storagedir(volumeName)
+}
+
+// parseByteSize parses a size in the `byteSizeFormat` (the suffixes are binary: 1k is 1024).
+func parseByteSize(value string) (int64, error) {
+	match := byteSizeFormat.FindStringSubmatch(value)
+	if match == nil {
+		return 0, errors.New("must be a number of bytes with an optional k, m, g, or t suffix (e.g., 10g)")
+	}
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	shift := strings.Index("kmgt", strings.ToLower(match[2])) + 1 // 0 for no suffix
+	if size > (1<<63-1)>>(10*shift) {
+		return 0, errors.New("is too large")
+	}
+	return size << (10 * shift), nil
+}
+
+// volumeTreeCreateQuota creates the volume's quota image of `size` bytes (see quota.go), mounts it and moves the
+// volume's upperdir onto it. The upperdir must be empty.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeCreateQuota(volumeName string, size int64) error {
+	// Preparing the image aside, so that the volume does not have a broken image if something fails
+	tmpimg := d.quotaimg(volumeName) + ".tmp"
+	img, err := os.Create(tmpimg)
+	if err == nil {
+		err = img.Truncate(size) // Sparse: takes no space until the files are written
+		err = errors.Join(err, img.Close())
+	}
+	if err == nil {
+		var output []byte
+		output, err = exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", "-E", "nodiscard", tmpimg).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("mkfs.ext4 failed: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpimg, d.quotaimg(volumeName))
+	}
+	if err != nil {
+		log.Errorf("Failed to create the quota image for volume %s: %v", volumeName, err)
+		_ = os.Remove(tmpimg)
+		return internalError("failed to create the quota image (is mkfs.ext4 installed?)", err)
+	}
+
+	err = d.volumeTreeMountQuota(volumeName)
+	if err == nil {
+		err = os.Mkdir(d.upperdir(volumeName), os.ModePerm)
+	}
+	if err == nil {
+		err = os.Remove(d.storagedir(volumeName) + "upper")
+	}
+	if err != nil {
+		log.Errorf("Failed to set up the quota image for volume %s: %v", volumeName, err)
+		return internalError("failed to set up the quota image", err)
+	}
+	return nil
+}
+
+// volumeTreeMountQuota loop-mounts the volume's quota image at quota/, unless the volume has no quota or the image
+// is already mounted. Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeMountQuota(volumeName string) error {
+	if _, err := os.Stat(d.quotaimg(volumeName)); os.IsNotExist(err) {
+		return nil
+	}
+	quotadir := d.quotadir(volumeName)
+	if mounted, err := isMountpoint(quotadir); err != nil || mounted {
+		return err
+	}
+
+	if err := os.MkdirAll(quotadir, os.ModePerm); err != nil {
+		return err
+	}
+	loop, loopfd, err := attachLoop(d.quotaimg(volumeName))
+	if err != nil {
+		return err
+	}
+	// The loop device is detached automatically when it is closed and unmounted
+	defer unix.Close(loopfd)
+
+	if err = syscall.Mount(loop, quotadir, "ext4", 0, "discard"); err != nil {
+		return &os.PathError{Op: "mount", Path: quotadir, Err: err}
+	}
+	return nil
+}
+
+// volumeTreeUnmountQuota unmounts the volume's quota image (lazily, so that it is detached even if it is still in
+// use), if it is mounted. Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeUnmountQuota(volumeName string) error {
+	quotadir := d.quotadir(volumeName)
+	mounted, err := isMountpoint(quotadir)
+	if err == nil && mounted {
+		err = syscall.Unmount(quotadir, syscall.MNT_DETACH)
+		if err != nil {
+			err = &os.PathError{Op: "unmount", Path: quotadir, Err: err}
+		}
+	}
+	return err
+}
+
+// quotaUsage returns the number of bytes used in the volume's quota image and the number of bytes available for the
+// files in it in total. The image must be mounted. Errors are returned but not logged.
+func (d *DockerOnTop) quotaUsage(volumeName string) (int64, int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(d.quotadir(volumeName), &stat); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: d.quotadir(volumeName), Err: err}
+	}
+	return int64(stat.Blocks-stat.Bfree) * stat.Bsize, int64(stat.Blocks) * stat.Bsize, nil
+}
+
+// attachLoop attaches the file to a free loop device (with the autoclear flag) and returns the loop device's path and
+// file descriptor, which must be closed by the caller.
+func attachLoop(path string) (string, int, error) {
+	img, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", -1, err
+	}
+	defer img.Close()
+
+	ctlfd, err := unix.Open("/dev/loop-control", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", -1, &os.PathError{Op: "open", Path: "/dev/loop-control", Err: err}
+	}
+	defer unix.Close(ctlfd)
+
+	// Another process might take the free device in the meantime, so retrying a few times
+	for attempt := 0; ; attempt++ {
+		number, err := unix.IoctlRetInt(ctlfd, unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", -1, &os.PathError{Op: "ioctl LOOP_CTL_GET_FREE", Path: "/dev/loop-control", Err: err}
+		}
+		loop := fmt.Sprintf("/dev/loop%d", number)
+		loopfd, err := unix.Open(loop, unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return "", -1, &os.PathError{Op: "open", Path: loop, Err: err}
+		}
+
+		err = unix.IoctlSetInt(loopfd, unix.LOOP_SET_FD, int(img.Fd()))
+		if err == nil {
+			err = unix.IoctlLoopSetStatus64(loopfd, &unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR})
+			if err == nil {
+				return loop, loopfd, nil
+			}
+			_ = unix.IoctlSetInt(loopfd, unix.LOOP_CLR_FD, 0)
+		}
+		_ = unix.Close(loopfd)
+		if err != unix.EBUSY || attempt == 4 {
+			return "", -1, &os.PathError{Op: "attach", Path: loop, Err: err}
+		}
+	}
+}
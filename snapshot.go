@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotInfo is the metadata of a snapshot of a volume's changes (that is, of its upperdir). History generations
+// (see history.go) are stored the same way as snapshots and are described by it too.
+type snapshotInfo struct {
+	Name      string
+	CreatedAt time.Time
+	// Size is the total size of the files in the snapshot, in bytes (the actual disk usage may be less, see
+	// `copyFileData`)
+	Size int64
+}
+
+func (d *DockerOnTop) snapshotsdir(volumeName string) string {
+	// On the same filesystem as the upperdir (unless the volume has a quota), so that the files can be reflinked
+	return d.storagedir(volumeName) + "snapshots/"
+}
+
+// snapshotCreate saves a copy of the volume's current changes as a snapshot with the given name.
+//
+// The volume may be in use, but the snapshot then captures the files in whatever state they are at the moment, so
+// it's best to only take snapshots of unused volumes. The lock on activemounts/ is held during the copying, so the
+// volume is not mounted or unmounted in the process.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) snapshotCreate(volumeName string, snapshotName string) (snapshotInfo, error) {
+	if !volNameFormat.MatchString(snapshotName) {
+		log.Debug("Snapshot name doesn't comply to the regex. Snapshot not created")
+		return snapshotInfo{}, errors.New("snapshot name contains illegal characters: " +
+			"it should comply to \"[a-zA-Z0-9][a-zA-Z0-9_.-]*\"")
+	}
+
+	var activemountsdir lockedFile
+	err := activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return snapshotInfo{}, err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	snapshotdir := d.snapshotsdir(volumeName) + snapshotName
+	if _, err = os.Stat(snapshotdir); err == nil {
+		log.Debugf("Snapshot %s of %s already exists", snapshotName, volumeName)
+		return snapshotInfo{}, fmt.Errorf("snapshot %s already exists", snapshotName)
+	}
+
+	info, err := d.saveUpper(volumeName, d.snapshotsdir(volumeName), snapshotName)
+	if err != nil {
+		log.Errorf("Failed to create snapshot %s of %s: %v", snapshotName, volumeName, err)
+		return snapshotInfo{}, internalError("failed to create the snapshot", err)
+	}
+
+	log.Infof("Created snapshot %s of volume %s (%d bytes)", snapshotName, volumeName, info.Size)
+	return info, nil
+}
+
+// saveUpper saves a copy of the volume's upperdir together with its metadata (see `snapshotInfo`) as the directory
+// `name` inside `dir` (which is created if needed). The copy is first prepared under a temporary name (the `name`
+// prefixed with a dot), so a partially saved copy never shows up.
+//
+// The lock on activemounts/ must be held by the caller. Errors are returned but not logged.
+func (d *DockerOnTop) saveUpper(volumeName string, dir string, name string) (snapshotInfo, error) {
+	info := snapshotInfo{Name: name, CreatedAt: time.Now()}
+
+	tmpdir := dir + "." + name
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err == nil {
+		err = os.RemoveAll(tmpdir) // Might be left over from an interrupted attempt
+	}
+	if err == nil {
+		err = os.Mkdir(tmpdir, os.ModePerm)
+	}
+	if err != nil {
+		return info, err
+	}
+
+	err = copyTree(d.upperdir(volumeName), tmpdir+"/upper")
+	if err == nil {
+		info.Size, err = dirSize(tmpdir + "/upper")
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(info)
+	}
+	if err == nil {
+		err = os.WriteFile(tmpdir+"/snapshot.json", payload, 0o666)
+	}
+	if err == nil {
+		err = os.Rename(tmpdir, dir+name)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmpdir)
+	}
+	return info, err
+}
+
+// listSavedUppers lists the copies of an upperdir saved by `saveUpper` inside `dir`, the oldest first. A missing
+// `dir` means there are none. Errors are returned but not logged.
+func listSavedUppers(dir string) ([]snapshotInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []snapshotInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue // A copy that is being saved (or has failed to be saved)
+		}
+		var info snapshotInfo
+		payload, err := os.ReadFile(dir + entry.Name() + "/snapshot.json")
+		if err == nil {
+			err = json.Unmarshal(payload, &info)
+		}
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, info)
+	}
+
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].CreatedAt.Before(saved[j].CreatedAt)
+	})
+	return saved, nil
+}
+
+// snapshotList lists the snapshots of the volume, the oldest first. Errors are logged and wrapped with
+// `internalError`.
+func (d *DockerOnTop) snapshotList(volumeName string) ([]snapshotInfo, error) {
+	snapshots, err := listSavedUppers(d.snapshotsdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to list snapshots of %s: %v", volumeName, err)
+		return nil, internalError("failed to list the snapshots", err)
+	}
+	return snapshots, nil
+}
+
+// snapshotRestore replaces the volume's changes with the ones saved in the snapshot (the snapshot is kept).
+//
+// The volume must not be in use: overlayfs does not allow to modify the upperdir of a mounted overlay. Neither must the
+// volumes stacked on it, which have the upperdir as a lower layer (see `lockIdleUpper`). The locks are held for the
+// whole operation, so none of them can be mounted in the process.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) snapshotRestore(volumeName string, snapshotName string) error {
+	release, err := d.lockIdleUpper(volumeName)
+	if err != nil {
+		// The error is already logged by `d.lockIdleUpper`
+		return err
+	}
+	defer release()
+
+	snapshotUpper := d.snapshotsdir(volumeName) + snapshotName + "/upper"
+	if _, err = os.Stat(snapshotUpper); os.IsNotExist(err) || !volNameFormat.MatchString(snapshotName) {
+		log.Debugf("Snapshot %s of %s does not exist", snapshotName, volumeName)
+		return fmt.Errorf("no such snapshot %s", snapshotName)
+	}
+
+	// The changes are about to be replaced, so a pending history generation is saved first (the errors are logged by
+	// `d.historyCatchUp`)
+	_ = d.historyCatchUp(volumeName)
+
+	// The error is already logged and wrapped in `internalError` by `d.volumeTreeReplaceUpper`
+	return d.volumeTreeReplaceUpper(volumeName, snapshotUpper)
+}
+
+// snapshotDelete deletes the snapshot of the volume. Errors are logged, and the ones that are not the user's fault are
+// wrapped with `internalError`.
+func (d *DockerOnTop) snapshotDelete(volumeName string, snapshotName string) error {
+	// Taking the lock so that the snapshot is not deleted while it is being restored
+	var activemountsdir lockedFile
+	err := activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	snapshotdir := d.snapshotsdir(volumeName) + snapshotName
+	if _, err = os.Stat(snapshotdir); os.IsNotExist(err) || !volNameFormat.MatchString(snapshotName) {
+		log.Debugf("Snapshot %s of %s does not exist", snapshotName, volumeName)
+		return fmt.Errorf("no such snapshot %s", snapshotName)
+	}
+
+	if err = os.RemoveAll(snapshotdir); err != nil {
+		log.Errorf("Failed to RemoveAll snapshot %s of %s: %v", snapshotName, volumeName, err)
+		return internalError("failed to delete the snapshot", err)
+	}
+	return nil
+}
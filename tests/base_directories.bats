@@ -0,0 +1,54 @@
+#!/usr/bin/env bats
+
+@test "Base directories with special characters in their paths are mounted" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	mkdir "$BASE"/'we,ird:na\me'
+	# A colon and a backslash are escaped with a backslash, a comma is not
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"/'we,ird\:na\\me'
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/'we,ird:na\me'/a
+
+	[ "$(docker volume inspect -f '{{ .Status.Base }}' "$NAME")" = "$BASE"/'we,ird\:na\\me' ]
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 123 ]
+		echo 456 > /dot/b
+	'
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = "$(echo 123; echo 456)" ]
+}
+
+@test "Several base directories are stacked, the topmost first" {
+	TOP="$(mktemp --directory)"
+	BOTTOM="$(mktemp --directory)"
+	NAME="$(basename "$TOP")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$TOP:$BOTTOM"
+
+	# Deferred cleanup
+	trap 'rm -rf "$TOP" "$BOTTOM"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo top > "$TOP"/a
+	echo bottom > "$BOTTOM"/a
+	echo bottom > "$BOTTOM"/b
+	mkdir "$TOP"/d "$BOTTOM"/d
+	echo top > "$TOP"/d/x
+	echo bottom > "$BOTTOM"/d/y
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = top ]
+		[ "$(cat /dot/b)" = bottom ]
+		# Directories are merged
+		[ "$(cat /dot/d/x)" = top ]
+		[ "$(cat /dot/d/y)" = bottom ]
+
+		echo 123 > /dot/b
+		rm /dot/a
+	'
+
+	# Changes are not visible from the host, and a file removed from the topmost base is not revealed from below
+	[ "$(cat "$TOP"/a)" = top ]
+	[ "$(cat "$BOTTOM"/b)" = bottom ]
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'ls /dot; cat /dot/b')" = "$(echo b; echo d; echo 123)" ]
+}
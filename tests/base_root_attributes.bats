@@ -0,0 +1,21 @@
+#!/usr/bin/env bats
+
+@test "Volume root has the owner and mode of the base root" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	chown 1000:1000 "$BASE"
+	chmod 0750 "$BASE"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest stat -c '%u:%g %a' /dot)" = "1000:1000 750" ]
+
+	# A non-root container can write to the volume, also after the changes are discarded
+	docker run --rm --user 1000 -v "$NAME":/dot alpine:latest touch /dot/a
+	docker run --rm --user 1000 -v "$NAME":/dot alpine:latest sh -e -c '
+		[ ! -e /dot/a ]
+		touch /dot/b
+	'
+}
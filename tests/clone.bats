@@ -0,0 +1,34 @@
+#!/usr/bin/env bats
+
+@test "A clone starts with the changes of the original volume and is independent from it" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME" "$NAME"-clone; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	echo 456 > "$BASE"/b
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		rm /dot/a
+		echo 789 > /dot/b
+		mkdir /dot/d
+		echo etc > /dot/d/c
+	'
+
+	docker volume create --driver docker-on-top "$NAME"-clone -o clonefrom="$NAME"
+	[ "$(docker volume inspect -f '{{ .Status.Base }}' "$NAME"-clone)" = "$BASE" ]
+
+	docker run --rm -v "$NAME"-clone:/dot alpine:latest sh -e -c '
+		[ ! -e /dot/a ]
+		[ "$(cat /dot/b)" = 789 ]
+		[ "$(cat /dot/d/c)" = etc ]
+		echo clone > /dot/b
+	'
+
+	# The volumes' changes are independent
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/b)" = 789 ]
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo original > /dot/e'
+	[ "$(docker run --rm -v "$NAME"-clone:/dot alpine:latest sh -c 'ls /dot; cat /dot/b')" = "$(echo b; echo d; echo clone)" ]
+}
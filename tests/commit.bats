@@ -0,0 +1,85 @@
+#!/usr/bin/env bats
+
+# For `fails`, `docker_on_top`
+load common.sh
+
+@test "Commit applies the changes to the base directory" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+
+	# Deferred cleanup (the committed files are owned by the container's root)
+	trap 'sudo rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	echo 456 > "$BASE"/b
+	mkdir "$BASE"/d
+	echo 1 > "$BASE"/d/x
+	echo 2 > "$BASE"/d/y
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		# A whiteout
+		rm /dot/a
+		# A modified file
+		echo 789 > /dot/b
+		# A new file
+		echo etc > /dot/c
+		# An opaque directory
+		rm -r /dot/d
+		mkdir /dot/d
+		echo 3 > /dot/d/z
+	'
+
+	[ "$(docker_on_top commit -dry-run "$NAME")" = "$(printf '%s\n' 'D /a' 'M /b' 'A /c' \
+		'M /d (replaces the base directory)' 'A /d/z')" ]
+	# Nothing is applied by a dry run
+	[ "$(cat "$BASE"/a)" = 123 ]
+
+	docker_on_top commit "$NAME"
+
+	[ ! -e "$BASE"/a ]
+	[ "$(cat "$BASE"/b)" = 789 ]
+	[ "$(cat "$BASE"/c)" = etc ]
+	[ "$(ls "$BASE"/d)" = z ]
+	[ "$(cat "$BASE"/d/z)" = 3 ]
+	# Nothing is left over in the base
+	[ "$(ls -A "$BASE")" = "$(printf '%s\n' b c d)" ]
+
+	# The volume looks the same, with no changes of its own left
+	[ -z "$(docker_on_top diff "$NAME")" ]
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ ! -e /dot/a ]
+		[ "$(cat /dot/b)" = 789 ]
+		[ "$(cat /dot/c)" = etc ]
+		[ "$(ls /dot/d)" = z ]
+	'
+}
+
+@test "Commit refuses while a volume on the same base is in use" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+	docker volume create --driver docker-on-top "$NAME"-other -o base="$BASE"
+
+	# Deferred cleanup
+	trap 'sudo rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME" "$NAME"-other;
+		trap - RETURN' RETURN
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 123 > /dot/a'
+
+	# The volume itself is in use
+	CONTAINER_ID=$(docker run -d -v "$NAME":/dot alpine:latest sleep 3)
+	sleep 1
+	fails docker_on_top commit "$NAME"
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+
+	# Another volume on the same base is in use
+	CONTAINER_ID=$(docker run -d -v "$NAME"-other:/dot alpine:latest sleep 3)
+	sleep 1
+	fails docker_on_top commit "$NAME"
+	[ ! -e "$BASE"/a ]
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+
+	docker_on_top commit "$NAME"
+	[ "$(cat "$BASE"/a)" = 123 ]
+}
@@ -25,3 +25,14 @@ CONTAINER_CMD_CHECK_ALREADY_MODIFIED_DATA='
 	[ "$(cat /dot/b)" = 789 ]
 	[ "$(cat /dot/c)" = etc ]
 '
+
+# `! command` does not fail a test when the command succeeds (neither in bats nor with `set -e`), so expected failures
+# are checked with `fails command` instead
+fails() {
+	! "$@"
+}
+
+# Runs an admin command (see the README) of the plugin built in the repository's root
+docker_on_top() {
+	sudo "$BATS_TEST_DIRNAME"/../docker-on-top "$@"
+}
@@ -0,0 +1,21 @@
+#!/usr/bin/env bats
+
+@test "Exclusive volume is used by one container at a time" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o exclusive=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	CONTAINER_ID=$(docker run --name "$NAME" -d -v "$NAME":/dot alpine:latest sleep 3)
+	sleep 1
+
+	! docker run --rm -v "$NAME":/dot alpine:latest true
+
+	# `docker cp` mounts the volume again for the same container, which is fine
+	docker cp "$NAME":/etc/hostname "$BASE/"
+
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+	docker run --rm -v "$NAME":/dot alpine:latest true
+}
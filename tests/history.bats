@@ -0,0 +1,32 @@
+#!/usr/bin/env bats
+
+# For `docker_on_top`
+load common.sh
+
+# Prints the generations in the volume's history
+history_generations() {
+	docker_on_top history ls "$1" | tail -n +2 | cut -d ' ' -f 1
+}
+
+@test "The last states of a volume are kept in its history" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o history=2
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	for i in 1 2 3; do
+		docker run --rm -v "$NAME":/dot alpine:latest sh -c "echo $i > /dot/a"
+		# The generation is saved in the background
+		sleep 1
+	done
+
+	# The oldest generation is pruned, the numbers are not reused
+	[ "$(history_generations "$NAME")" = "$(echo 2; echo 3)" ]
+
+	docker_on_top history restore "$NAME" 2
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 2 ]
+	sleep 1
+	[ "$(history_generations "$NAME")" = "$(echo 3; echo 4)" ]
+}
@@ -0,0 +1,41 @@
+#!/usr/bin/env bats
+
+@test "A read-only volume cannot be modified" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o ro=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 123 ]
+		# `!` would not fail the script
+		if echo 456 > /dot/a || touch /dot/b; then false; fi
+		[ "$(cat /dot/a)" = 123 ]
+		[ ! -e /dot/b ]
+	'
+	[ "$(docker volume inspect -f '{{ .Status.UpperSize }}' "$NAME")" = 0 ]
+}
+
+@test "Files cannot be executed from a noexec volume" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o noexec=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	printf '#!/bin/sh\necho 123\n' > "$BASE"/script
+	chmod +x "$BASE"/script
+	[ "$("$BASE"/script)" = 123 ]
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		if /dot/script; then false; fi
+		# The files can still be read and modified
+		[ "$(sh /dot/script)" = 123 ]
+		echo 456 > /dot/a
+	'
+}
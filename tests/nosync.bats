@@ -0,0 +1,21 @@
+#!/usr/bin/env bats
+
+@test "The changes of a nosync volume are discarded if it was not unmounted properly" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=remove -o nosync=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 456 > /dot/a; echo 789 > /dot/b'
+
+	# The changes are kept between the containers in the `remove` mode...
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = "$(echo 456; echo 789)" ]
+
+	# ...unless the overlay was left dirty, e.g., by a crash. Then overlayfs leaves this marker in the workdir, and
+	# the changes might have not been synced to the disk
+	sudo mkdir -p /var/lib/docker-on-top/"$NAME"/workdir/work/incompat/volatile
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = 123 ]
+}
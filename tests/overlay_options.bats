@@ -0,0 +1,55 @@
+#!/usr/bin/env bats
+
+# For `fails`
+load common.sh
+
+@test "Only the vetted overlay options with valid values are accepted" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+
+	# Not one of the allowed values
+	fails docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o redirect_dir=maybe
+	# A flag only takes a boolean
+	fails docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o userxattr=on
+	# Not an overlay option that docker-on-top lets through
+	fails docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o lowerdir=/etc
+
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o redirect_dir=on
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	[ "$(docker volume inspect -f '{{ .Status.OverlayOptions.redirect_dir }}' "$NAME")" = on ]
+
+	echo 123 > "$BASE"/a
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 123 ]
+}
+
+@test "Overlay options that the kernel rejects fail the volume creation" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; trap - RETURN' RETURN
+
+	# Metacopy requires redirects to be followed
+	ERROR="$(docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o metacopy=on \
+		-o redirect_dir=off 2>&1 || true)"
+	[[ "$ERROR" = *"cannot be mounted with the requested options"* ]]
+
+	# The volume is not left behind
+	fails docker volume inspect -f '{{ .Name }}' "$NAME"
+}
+
+@test "A missing base directory is reported as such on mount" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o redirect_dir=on
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	rmdir "$BASE"
+	ERROR="$(docker run --rm -v "$NAME":/dot alpine:latest true 2>&1 || true)"
+	[[ "$ERROR" = *"something is missing"* ]]
+}
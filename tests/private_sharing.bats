@@ -0,0 +1,38 @@
+#!/usr/bin/env bats
+
+@test "Containers don't see each other's changes in a private volume" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o sharing=private
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+
+	CONTAINER_ID=$(docker run -d -v "$NAME":/dot alpine:latest sh -e -c '
+		echo 456 > /dot/a
+		sleep 2
+		[ "$(cat /dot/a)" = 456 ]
+		[ ! -e /dot/b ]
+	')
+	sleep 1
+
+	# There is no shared mountpoint, only the container's own one
+	[ -z "$(docker volume inspect -f '{{ .Mountpoint }}' "$NAME")" ]
+	[ "$(docker volume inspect -f '{{ len .Status.PrivateMountpoints }}' "$NAME")" = 1 ]
+
+	# Another container sees the base, not the first container's changes
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 123 ]
+		echo 789 > /dot/b
+	'
+
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+	[ "$(docker volume inspect -f '{{ len .Status.PrivateMountpoints }}' "$NAME")" = 0 ]
+
+	# The changes are discarded when the containers stop, and the base is intact
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = 123 ]
+	[ "$(cat "$BASE"/a)" = 123 ]
+	[ ! -e "$BASE"/b ]
+}
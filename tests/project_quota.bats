@@ -0,0 +1,32 @@
+#!/usr/bin/env bats
+
+@test "Changes to a volume are limited by its project quota" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	if ! docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o quota=20m -o quotamode=project; then
+		rm -rf "$BASE"
+		skip "the dot root directory's filesystem does not support project quotas"
+	fi
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	echo 456 > "$BASE"/b
+
+	[ "$(docker volume inspect -f '{{ .Status.QuotaMode }}' "$NAME")" = project ]
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		# Modifying and removing base files (copy up and whiteouts go through the workdir)
+		echo 789 > /dot/a
+		rm /dot/b
+		# Does not fit
+		! dd if=/dev/zero of=/dot/big bs=1M count=32
+		rm /dot/big
+	'
+
+	# The changes are kept, and the base is intact
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = 789 ]
+	[ "$(cat "$BASE"/a)" = 123 ]
+	[ "$(cat "$BASE"/b)" = 456 ]
+}
@@ -0,0 +1,23 @@
+#!/usr/bin/env bats
+
+@test "Changes to a volume are limited by its quota" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o quota=20m
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	[ "$(docker volume inspect -f '{{ .Status.Quota }}' "$NAME")" = 20971520 ]
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		echo 123 > /dot/a
+		# Does not fit
+		! dd if=/dev/zero of=/dot/big bs=1M count=32
+		rm /dot/big
+	'
+
+	# The changes are kept
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 123 ]
+	[ ! -e "$BASE"/a ]
+}
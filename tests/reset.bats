@@ -0,0 +1,41 @@
+#!/usr/bin/env bats
+
+# For `fails`, `docker_on_top`
+load common.sh
+
+@test "Reset discards the changes to one path or to the whole volume" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	mkdir "$BASE"/d
+	echo 456 > "$BASE"/d/b
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		echo 789 > /dot/a
+		rm /dot/d/b
+		echo etc > /dot/d/c
+		echo new > /dot/e
+	'
+
+	docker_on_top reset "$NAME" /d
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/d/b)" = 456 ]
+		[ ! -e /dot/d/c ]
+		# The other changes are kept
+		[ "$(cat /dot/a)" = 789 ]
+		[ "$(cat /dot/e)" = new ]
+	'
+
+	CONTAINER_ID=$(docker run -d -v "$NAME":/dot alpine:latest sleep 3)
+	sleep 1
+	fails docker_on_top reset "$NAME" /a
+	fails docker_on_top reset "$NAME"
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+
+	docker_on_top reset "$NAME"
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'ls /dot; cat /dot/a')" = "$(echo a; echo d; echo 123)" ]
+}
@@ -0,0 +1,38 @@
+#!/usr/bin/env bats
+
+# For `fails`, `docker_on_top`
+load common.sh
+
+@test "Snapshots of the changes are created, restored and deleted" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 456 > /dot/a; echo 789 > /dot/b'
+
+	docker_on_top snapshot create "$NAME" good
+	fails docker_on_top snapshot create "$NAME" good
+	[ "$(docker_on_top snapshot ls "$NAME" | tail -n +2 | cut -d ' ' -f 1)" = good ]
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'rm /dot/a; echo etc > /dot/b; echo new > /dot/c'
+
+	docker_on_top snapshot restore "$NAME" good
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 456 ]
+		[ "$(cat /dot/b)" = 789 ]
+		[ ! -e /dot/c ]
+		echo changed > /dot/a
+	'
+
+	# The snapshot is kept after a restore and does not change with the volume
+	docker_on_top snapshot restore "$NAME" good
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 456 ]
+
+	docker_on_top snapshot rm "$NAME" good
+	[ -z "$(docker_on_top snapshot ls "$NAME" | tail -n +2)" ]
+	fails docker_on_top snapshot restore "$NAME" good
+}
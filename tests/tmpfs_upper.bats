@@ -0,0 +1,23 @@
+#!/usr/bin/env bats
+
+@test "Changes of a tmpfs-backed volume are limited in size" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=true -o upper=tmpfs -o size=1m
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 123 ]
+		echo 456 > /dot/a
+		# Does not fit
+		! dd if=/dev/zero of=/dot/big bs=1k count=2048
+	'
+
+	# The changes are discarded, and the base is intact
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = 123 ]
+	[ "$(cat "$BASE"/a)" = 123 ]
+}
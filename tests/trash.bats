@@ -0,0 +1,35 @@
+#!/usr/bin/env bats
+
+# For `fails`, `docker_on_top`
+load common.sh
+
+# Prints the generations in the volume's trash
+trash_generations() {
+	docker_on_top trash ls "$1" | tail -n +2 | cut -d ' ' -f 1
+}
+
+@test "The discarded changes of a volatile volume are kept in its trash and can be recovered" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=unmount -o trash=2
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	fails docker volume create --driver docker-on-top "$NAME"-remove -o base="$BASE" -o volatile=remove -o trash=2
+
+	echo 123 > "$BASE"/a
+	for i in 1 2 3; do
+		docker run --rm -v "$NAME":/dot alpine:latest sh -c "echo $i > /dot/a"
+	done
+
+	# Only the last generations are kept
+	[ "$(trash_generations "$NAME")" = "$(echo 2; echo 3)" ]
+	fails docker_on_top trash restore "$NAME" 1
+
+	docker_on_top trash restore "$NAME" 2
+	# The restored changes are seen by the next container and then discarded again
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 2 ]
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 123 ]
+	[ "$(trash_generations "$NAME")" = "$(echo 3; echo 4)" ]
+}
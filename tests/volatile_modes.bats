@@ -0,0 +1,40 @@
+#!/usr/bin/env bats
+
+# Prints the size of the changes stored for the volume
+upper_size() {
+	docker volume inspect -f '{{ .Status.UpperSize }}' "$1"
+}
+
+# Makes a change in a volume with the volatile mode `$1` and checks the size of the changes stored right after the
+# container exits (`$2`) and after the next container exits (`$3`)
+volatile_mode_test() {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile="$1"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 456 > /dot/a'
+	[ "$(upper_size "$NAME")" = "$2" ]
+
+	if [ "$1" = remove ]; then
+		[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 456 ]
+	else
+		[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 123 ]
+	fi
+	[ "$(upper_size "$NAME")" = "$3" ]
+}
+
+@test "volatile=mount discards the changes when the volume is mounted again" {
+	volatile_mode_test mount 4 0
+}
+
+@test "volatile=unmount discards the changes as soon as the volume is unmounted" {
+	volatile_mode_test unmount 0 0
+}
+
+@test "volatile=remove keeps the changes until the volume is removed" {
+	volatile_mode_test remove 4 4
+}
@@ -0,0 +1,80 @@
+#!/usr/bin/env bats
+
+# For `fails`, `docker_on_top`
+load common.sh
+
+@test "A volume stacked on another one sees its changes" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+	docker volume create --driver docker-on-top "$NAME"-child -o basevolume="$NAME"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker volume rm "$NAME"-child "$NAME"; trap - RETURN' RETURN
+
+	echo 123 > "$BASE"/a
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 456 > /dot/b'
+
+	docker run --rm -v "$NAME"-child:/dot alpine:latest sh -e -c '
+		[ "$(cat /dot/a)" = 123 ]
+		[ "$(cat /dot/b)" = 456 ]
+		rm /dot/a
+		echo 789 > /dot/c
+	'
+
+	# The child's changes are its own
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest sh -c 'cat /dot/*')" = "$(echo 123; echo 456)" ]
+	[ "$(docker volume inspect -f '{{ .Status.BaseVolume }}' "$NAME"-child)" = "$NAME" ]
+}
+
+@test "A volume with volumes stacked on it can neither be removed nor committed" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE"
+	docker volume create --driver docker-on-top "$NAME"-child -o basevolume="$NAME"
+
+	# Deferred cleanup
+	trap 'sudo rm -rf "$BASE"; docker volume rm "$NAME"-child "$NAME"; trap - RETURN' RETURN
+
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 123 > /dot/a'
+
+	fails docker volume rm "$NAME"
+	fails docker_on_top commit "$NAME"
+	[ ! -e "$BASE"/a ]
+
+	docker volume rm "$NAME"-child
+	docker_on_top commit "$NAME"
+	[ "$(cat "$BASE"/a)" = 123 ]
+	docker volume create --driver docker-on-top "$NAME"-child -o basevolume="$NAME"
+}
+
+@test "The changes of a volume are not replaced while a volume stacked on it is in use" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=mount
+	docker volume create --driver docker-on-top "$NAME"-child -o basevolume="$NAME"
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME"-child "$NAME";
+		trap - RETURN' RETURN
+
+	docker_on_top snapshot create "$NAME" empty
+	docker run --rm -v "$NAME":/dot alpine:latest sh -c 'echo 123 > /dot/a'
+
+	CONTAINER_ID=$(docker run -d -v "$NAME"-child:/dot alpine:latest sh -e -c '
+		sleep 4
+		[ "$(cat /dot/a)" = 123 ]
+	')
+	sleep 1
+
+	fails docker_on_top reset "$NAME"
+	fails docker_on_top reset "$NAME" /a
+	fails docker_on_top snapshot restore "$NAME" empty
+	# The volatile volume can still be mounted, but its changes are kept
+	[ "$(docker run --rm -v "$NAME":/dot alpine:latest cat /dot/a)" = 123 ]
+
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+
+	# Discarded as usual once the child is not in use
+	[ -z "$(docker run --rm -v "$NAME":/dot alpine:latest ls /dot)" ]
+}
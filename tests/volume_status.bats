@@ -0,0 +1,25 @@
+#!/usr/bin/env bats
+
+@test "Volume status is reported" {
+	BASE="$(mktemp --directory)"
+	NAME="$(basename "$BASE")"
+	docker volume create --driver docker-on-top "$NAME" -o base="$BASE" -o volatile=true
+
+	# Deferred cleanup
+	trap 'rm -rf "$BASE"; docker container rm -f "$CONTAINER_ID"; docker volume rm "$NAME"; trap - RETURN' RETURN
+
+	[ "$(docker volume inspect -f '{{ .Status.Base }}' "$NAME")" = "$BASE" ]
+	[ "$(docker volume inspect -f '{{ .Status.Volatile }}' "$NAME")" = true ]
+	[ "$(docker volume inspect -f '{{ .Status.Mounted }}' "$NAME")" = false ]
+	[ -n "$(docker volume inspect -f '{{ .CreatedAt }}' "$NAME")" ]
+
+	CONTAINER_ID=$(docker run -d -v "$NAME":/dot alpine:latest sh -c 'echo 123 > /dot/a; sleep 5')
+	sleep 1
+
+	[ "$(docker volume inspect -f '{{ .Status.Mounted }}' "$NAME")" = true ]
+	[ "$(docker volume inspect -f '{{ len .Status.ActiveMounts }}' "$NAME")" = 1 ]
+	[ "$(docker volume inspect -f '{{ .Status.UpperSize }}' "$NAME")" = 4 ]
+
+	[ 0 -eq "$(docker wait "$CONTAINER_ID")" ]
+	[ "$(docker volume inspect -f '{{ .Status.Mounted }}' "$NAME")" = false ]
+}
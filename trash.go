@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A volatile volume created with the `trash=N` and/or `trashmaxage=<duration>` options does not delete its changes
+// when they are discarded, but moves them to the trash as the next numbered generation (stored just like a snapshot,
+// see snapshot.go). The last N generations are kept, and the ones older than the max age are deleted. Thus, if a
+// volume was made volatile by mistake, its changes can still be recovered.
+
+// keepuppermarker is the file that tells `volumeTreePreMount` not to discard the changes restored from the trash on
+// the next mount (see `trashRestore`)
+func (d *DockerOnTop) keepuppermarker(volumeName string) string {
+	return d.dotRootDir + volumeName + "/keepupper"
+}
+
+func (d *DockerOnTop) trashdir(volumeName string) string {
+	// In the same place as the upperdir, so that it can be moved to the trash rather than copied
+	return d.storagedir(volumeName) + "trash/"
+}
+
+// volumeTreeDiscardUpper discards the changes of a volatile volume: moves them to the trash, if the volume has it
+// enabled, or deletes them otherwise (see `volumeTreeResetUpper`).
+//
+// The volume must not be mounted.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeDiscardUpper(volumeName string) error {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to retrieve the volume's metadata", err)
+	}
+	if vol.Trash == 0 && vol.TrashMaxAge == 0 {
+		// The error is already logged and wrapped in `internalError` by `d.volumeTreeResetUpper`
+		return d.volumeTreeResetUpper(volumeName)
+	}
+
+	empty, err := isEmptyDir(d.upperdir(volumeName))
+	if os.IsNotExist(err) {
+		// A previous discard has moved the changes to the trash but failed to create the new upperdir
+		err = os.Mkdir(d.upperdir(volumeName), os.ModePerm)
+		if err == nil {
+			err = d.volumeTreeCopyBaseRoot(volumeName, d.upperdir(volumeName))
+		}
+		if err != nil {
+			log.Errorf("Failed to recreate upperdir of %s: %v", volumeName, err)
+			return internalError("failed to create upperdir after discarding changes", err)
+		}
+		return nil
+	} else if err != nil {
+		log.Errorf("Failed to list upperdir of %s: %v", volumeName, err)
+		return internalError("failed to list the changes", err)
+	} else if empty {
+		return nil // Nothing to discard
+	}
+
+	if err = d.trashRecover(volumeName); err != nil {
+		log.Errorf("Failed to recover interrupted trash generations of %s: %v", volumeName, err)
+		return internalError("failed to recover the trash", err)
+	}
+	generations, err := listGenerations(d.trashdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to list trash of %s: %v", volumeName, err)
+		return internalError("failed to list the trash", err)
+	}
+	next := 1
+	if len(generations) > 0 {
+		next = generationNumber(generations[len(generations)-1]) + 1
+	}
+
+	info, err := d.trashUpper(volumeName, strconv.Itoa(next))
+	if err != nil {
+		log.Errorf("Failed to move the changes of %s to the trash: %v", volumeName, err)
+		return internalError("failed to move the discarded changes to the trash", err)
+	}
+	log.Debugf("Moved changes of volume %s to the trash as generation %d (%d bytes)", volumeName, next, info.Size)
+
+	generations = append(generations, info)
+	for i, generation := range generations {
+		tooMany := vol.Trash > 0 && len(generations)-i > vol.Trash
+		tooOld := vol.TrashMaxAge > 0 && time.Since(generation.CreatedAt) > vol.TrashMaxAge
+		if tooMany || tooOld {
+			if err = os.RemoveAll(d.trashdir(volumeName) + generation.Name); err != nil {
+				log.Errorf("Failed to delete trash generation %s of %s: %v", generation.Name, volumeName, err)
+				return internalError("failed to delete an old trash generation", err)
+			}
+		}
+	}
+	return nil
+}
+
+// trashUpper moves the volume's upperdir to the trash as the generation `name` and creates a new empty upperdir.
+// Unlike `DockerOnTop.saveUpper`, nothing is copied.
+//
+// The generation is prepared under a temporary name (see `DockerOnTop.saveUpper`), but once the changes are moved
+// there, it is never deleted: if the process is interrupted, it is recovered by `trashRecover`. If the new upperdir
+// fails to be created, the generation is kept in the trash anyway. Errors are returned but not logged.
+func (d *DockerOnTop) trashUpper(volumeName string, name string) (snapshotInfo, error) {
+	info := snapshotInfo{Name: name, CreatedAt: time.Now()}
+
+	tmpdir := d.trashdir(volumeName) + "." + name
+	err := os.MkdirAll(d.trashdir(volumeName), os.ModePerm)
+	if err == nil {
+		err = os.RemoveAll(tmpdir) // Might be left over from an interrupted attempt
+	}
+	if err == nil {
+		err = os.Mkdir(tmpdir, os.ModePerm)
+	}
+	if err == nil {
+		info.Size, err = dirSize(d.upperdir(volumeName))
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(info)
+	}
+	if err == nil {
+		err = os.WriteFile(tmpdir+"/snapshot.json", payload, 0o666)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmpdir)
+		return info, err
+	}
+
+	if err = os.Rename(d.upperdir(volumeName), tmpdir+"/upper"); err != nil {
+		_ = os.RemoveAll(tmpdir)
+		return info, err
+	}
+	if err = os.Rename(tmpdir, d.trashdir(volumeName)+name); err != nil {
+		// Putting the changes back. If even that fails, they are recovered by `trashRecover` next time
+		if os.Rename(tmpdir+"/upper", d.upperdir(volumeName)) == nil {
+			_ = os.RemoveAll(tmpdir)
+		}
+		return info, err
+	}
+
+	err = os.Mkdir(d.upperdir(volumeName), os.ModePerm)
+	if err == nil {
+		err = d.volumeTreeCopyBaseRoot(volumeName, d.upperdir(volumeName))
+	}
+	return info, err
+}
+
+// trashRecover turns the trash generations whose preparation has been interrupted after the changes were moved into
+// them (see `trashUpper`) into normal ones, so that they are not deleted. Errors are returned but not logged.
+func (d *DockerOnTop) trashRecover(volumeName string) error {
+	entries, err := os.ReadDir(d.trashdir(volumeName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := strings.TrimPrefix(entry.Name(), ".")
+		if name == entry.Name() {
+			continue
+		}
+		tmpdir := d.trashdir(volumeName) + entry.Name()
+		if _, err = os.Stat(tmpdir + "/upper"); os.IsNotExist(err) {
+			continue // No changes in it, it's deleted by `trashUpper` when the name is used again
+		} else if err != nil {
+			return err
+		}
+		log.Warningf("Recovering interrupted trash generation %s of %s", name, volumeName)
+		if err = os.Rename(tmpdir, d.trashdir(volumeName)+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmptyDir tells if the directory has no entries.
+func isEmptyDir(path string) (bool, error) {
+	entries, err := os.ReadDir(path)
+	return len(entries) == 0, err
+}
+
+// trashList lists the trash generations of the volume, the oldest first. Errors are logged and wrapped with
+// `internalError`.
+func (d *DockerOnTop) trashList(volumeName string) ([]snapshotInfo, error) {
+	generations, err := listGenerations(d.trashdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to list trash of %s: %v", volumeName, err)
+		return nil, internalError("failed to list the trash", err)
+	}
+	return generations, nil
+}
+
+// trashRestore replaces the volume's changes with the ones in the trash generation (the generation is kept). The
+// restored changes are not discarded when the volume is mounted next time (see `keepuppermarker`), even in the
+// `volatileDiscardOnMount` mode, but after that the volume is volatile as usual.
+//
+// The volume must not be in use, and neither must the volumes stacked on it (see `lockIdleUpper`). The locks are held
+// for the whole operation, so none of them can be mounted in the process.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) trashRestore(volumeName string, generation string) error {
+	release, err := d.lockIdleUpper(volumeName)
+	if err != nil {
+		// The error is already logged by `d.lockIdleUpper`
+		return err
+	}
+	defer release()
+
+	generationUpper := d.trashdir(volumeName) + generation + "/upper"
+	if _, err = strconv.Atoi(generation); err != nil {
+		log.Debugf("Invalid trash generation %s of %s", generation, volumeName)
+		return fmt.Errorf("invalid trash generation %s: should be a number", generation)
+	} else if _, err = os.Stat(generationUpper); os.IsNotExist(err) {
+		log.Debugf("Trash generation %s of %s does not exist", generation, volumeName)
+		return fmt.Errorf("no such trash generation %s", generation)
+	}
+
+	if err = d.volumeTreeReplaceUpper(volumeName, generationUpper); err != nil {
+		// The error is already logged and wrapped in `internalError` by `d.volumeTreeReplaceUpper`
+		return err
+	}
+	if err = os.WriteFile(d.keepuppermarker(volumeName), nil, 0o666); err != nil {
+		log.Errorf("Failed to create the keep-upper marker of %s: %v", volumeName, err)
+		return internalError("restored, but failed to keep the changes from being discarded on the next mount", err)
+	}
+	return nil
+}
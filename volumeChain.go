@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A volume created with the `basevolume=<name>` option is stacked on top of another docker-on-top volume (the "parent")
+// instead of base directories: its lower layers are the parent's upperdir followed by the parent's own lower layers.
+// Chains of any length are possible. The parent cannot be removed (or committed) while it has children.
+//
+// The chain is resolved every time the volume is mounted, so the volume sees the parent's changes made up to that
+// point. Just like with base directories, the parent must not be modified while the child is mounted.
+
+// volumeLowerDirs returns the lower layers of the volume's overlay, the topmost first, resolving the chain of base
+// volumes, if any. Errors are returned but not logged.
+func (d *DockerOnTop) volumeLowerDirs(volumeName string) ([]string, error) {
+	var lowers []string
+	visited := make(map[string]bool)
+	for {
+		if visited[volumeName] {
+			return nil, fmt.Errorf("volume %s is its own base (the chain of base volumes has a cycle)", volumeName)
+		}
+		visited[volumeName] = true
+
+		vol, err := d.getVolumeInfo(volumeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve metadata for volume %s: %w", volumeName, err)
+		}
+		if vol.BaseVolume == "" {
+			return append(lowers, vol.BaseDirPaths...), nil
+		}
+		volumeName = vol.BaseVolume
+		lowers = append(lowers, d.upperdir(volumeName))
+	}
+}
+
+// volumeChildren lists the volumes that use the volume as their base volume. Volumes with missing or corrupt metadata
+// are skipped. Errors are returned but not logged.
+//
+// To make sure that no children are added after the check, the lock on the volume's activemounts/ should be held
+// (`DockerOnTop.Create` takes the lock of the base volume).
+func (d *DockerOnTop) volumeChildren(volumeName string) ([]string, error) {
+	entries, err := os.ReadDir(d.dotRootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, entry := range entries {
+		vol, err := d.getVolumeInfo(entry.Name())
+		if err == nil && vol.BaseVolume == volumeName {
+			children = append(children, entry.Name())
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
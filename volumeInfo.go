@@ -3,11 +3,67 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"time"
+)
+
+const (
+	// volatileDiscardOnMount is to discard the changes when the volume is mounted (after all the containers using it
+	// unmounted it)
+	volatileDiscardOnMount = "mount"
+	// volatileDiscardOnUnmount is to discard the changes when the last container using the volume unmounts it
+	volatileDiscardOnUnmount = "unmount"
+	// volatileDiscardOnRemove is to never discard the changes (until the volume is removed)
+	volatileDiscardOnRemove = "remove"
 )
 
 type VolumeInfo struct {
-	BaseDirPath string
-	Volatile    bool
+	// BaseDirPaths are the base directories of the volume (the lower layers of the overlay), the topmost first
+	BaseDirPaths []string
+	// BaseDirPath is the only base directory of a volume created by an older version of docker-on-top, which only
+	// supported a single base. `DockerOnTop.getVolumeInfo` moves it to `BaseDirPaths`, so it is empty otherwise.
+	BaseDirPath string `json:",omitempty"`
+	// BaseVolume is the name of the volume this volume is stacked on (see volumeChain.go). If it is set,
+	// `BaseDirPaths` is empty
+	BaseVolume string `json:",omitempty"`
+	Volatile   bool
+	// VolatileMode tells when the changes of a volatile volume are discarded: one of `volatileDiscardOnMount`,
+	// `volatileDiscardOnUnmount`, `volatileDiscardOnRemove`. Empty for non-volatile volumes. For volatile volumes
+	// created by older versions of docker-on-top, `DockerOnTop.getVolumeInfo` sets it to `volatileDiscardOnMount`.
+	VolatileMode string `json:",omitempty"`
+	// Private is set for a volume created with `sharing=private`, which gives each container its own overlay (see
+	// privateMount.go)
+	Private bool `json:",omitempty"`
+	// UpperTmpfs is set for a volatile volume with the `upper=tmpfs` option, whose changes are stored on a tmpfs of
+	// TmpfsSize (in the format of tmpfs's "size" option, empty for the default size) while it is mounted
+	UpperTmpfs bool   `json:",omitempty"`
+	TmpfsSize  string `json:",omitempty"`
+	// Quota is the limit of the size of the volume's changes in bytes, 0 means no quota. By default, it is the size of
+	// the quota image that holds the changes (see quota.go). If QuotaMode is `quotaModeProject`, it is enforced with
+	// the project quota of ProjectID instead (see projectQuota.go), and QuotaInodes is the limit of the number of
+	// inodes (0 for no limit)
+	Quota       int64  `json:",omitempty"`
+	QuotaMode   string `json:",omitempty"`
+	QuotaInodes uint64 `json:",omitempty"`
+	ProjectID   uint32 `json:",omitempty"`
+	// Pool is the storage pool the volume keeps its changes in (see `DockerOnTop.storagedir`), empty for none. The
+	// volume's directory in the pool is found through the storage symlink rather than the current pool config
+	Pool string `json:",omitempty"`
+	// Exclusive is set for a volume that may only be used by one container at a time
+	Exclusive bool `json:",omitempty"`
+	// MountFlags are the flags the overlay is mounted with (see `overlayMountFlags`)
+	MountFlags []string `json:",omitempty"`
+	// OverlayOptions are the overlayfs options the overlay is mounted with (see `overlayOptions`)
+	OverlayOptions map[string]string `json:",omitempty"`
+	// History is the number of history generations to keep (see history.go), 0 means the history is disabled
+	History int
+	// Trash is the number of trash generations of a volatile volume to keep, and TrashMaxAge is how long to keep
+	// them (see trash.go). If both are 0, the trash is disabled
+	Trash       int           `json:",omitempty"`
+	TrashMaxAge time.Duration `json:",omitempty"`
+
+	// CreatedAt is the time the volume was created at. It is zero for volumes created by older versions of
+	// docker-on-top, which did not store it (see `DockerOnTop.volumeCreatedAt`).
+	CreatedAt time.Time
 }
 
 func (d *DockerOnTop) metadatajson(volumeName string) string {
@@ -21,16 +77,44 @@ func (d *DockerOnTop) getVolumeInfo(volumeName string) (VolumeInfo, error) {
 	if err == nil {
 		err = json.Unmarshal(payload, &vol)
 	}
+	if vol.BaseDirPath != "" && len(vol.BaseDirPaths) == 0 {
+		vol.BaseDirPaths, vol.BaseDirPath = []string{vol.BaseDirPath}, ""
+	}
+	if vol.Volatile && vol.VolatileMode == "" {
+		vol.VolatileMode = volatileDiscardOnMount
+	}
 
 	return vol, err
 }
 
+// writeVolumeInfo writes the volume's metadata. The new metadata is written to a temporary file, which then replaces
+// metadata.json, so that the readers, which don't take any locks, never see it partially written.
 func (d *DockerOnTop) writeVolumeInfo(volumeName string, vol VolumeInfo) error {
 	payload, err := json.Marshal(vol)
 
+	tmp := d.metadatajson(volumeName) + ".new"
+	if err == nil {
+		err = os.WriteFile(tmp, payload, 0o666)
+	}
 	if err == nil {
-		err = os.WriteFile(d.metadatajson(volumeName), payload, 0o666)
+		err = os.Rename(tmp, d.metadatajson(volumeName))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
 	}
 
 	return err
 }
+
+// volumeCreatedAt returns the creation time of the volume. For volumes that don't have `VolumeInfo.CreatedAt` set,
+// the modification time of metadata.json is used instead, as it is only written once, when the volume is created.
+func (d *DockerOnTop) volumeCreatedAt(volumeName string, vol VolumeInfo) (time.Time, error) {
+	if !vol.CreatedAt.IsZero() {
+		return vol.CreatedAt, nil
+	}
+	stat, err := os.Stat(d.metadatajson(volumeName))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
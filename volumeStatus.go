@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// isMountpoint reports whether a filesystem is mounted on the given directory. It is detected by comparing the device
+// of the directory with the device of its parent, so bind mounts of a directory onto the same filesystem are not
+// detected (docker-on-top never creates those).
+//
+// If the directory does not exist, it is not considered an error: `false` is returned.
+func isMountpoint(path string) (bool, error) {
+	var stat, parentStat syscall.Stat_t
+	err := syscall.Stat(path, &stat)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	parent := filepath.Dir(filepath.Clean(path))
+	if err = syscall.Stat(parent, &parentStat); err != nil {
+		return false, &os.PathError{Op: "stat", Path: parent, Err: err}
+	}
+	return stat.Dev != parentStat.Dev, nil
+}
+
+// mountinfoUnescaper undoes the escaping of the paths in /proc/self/mountinfo
+var mountinfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// isListedMountpoint reports whether a filesystem is mounted on the given directory according to the mount table
+// (/proc/self/mountinfo). Unlike `isMountpoint`, it does not rely on the device numbers, so it is slower but suitable
+// for when a wrong answer leads to destructive actions.
+//
+// If the directory does not exist, it is not considered an error: `false` is returned.
+func isListedMountpoint(path string) (bool, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	payload, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(payload), "\n") {
+		// The fifth field is the mount point
+		fields := strings.Fields(line)
+		if len(fields) > 4 && mountinfoUnescaper.Replace(fields[4]) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dirSize returns the total size of regular files inside the directory (recursively). Symlinks are not followed.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// volumeStatus collects the information about the volume in the form it is reported to the docker daemon (e.g., for
+// `docker volume inspect`).
+//
+// The volume must exist. Errors are logged and wrapped with `internalError`.
+func (d *DockerOnTop) volumeStatus(volumeName string) (*volume.Volume, error) {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return nil, internalError("failed to retrieve the volume's metadata", err)
+	}
+
+	createdAt, err := d.volumeCreatedAt(volumeName, vol)
+	if err != nil {
+		log.Errorf("Failed to determine creation time of volume %s: %v", volumeName, err)
+		return nil, internalError("failed to determine the volume's creation time", err)
+	}
+
+	// Taking the lock so that the mount state and the active mounts are consistent with each other.
+	// For more details, read the comment at the beginning of `DockerOnTop.Mount`.
+	var activemountsdir lockedFile
+	err = activemountsdir.Open(d.activemountsdir(volumeName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return nil, err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	mounted, err := d.volumeMounted(volumeName)
+	if err != nil {
+		log.Errorf("Failed to check if volume %s is mounted: %v", volumeName, err)
+		return nil, internalError("failed to check if the volume is mounted", err)
+	}
+	activeMounts, err := d.readActiveMounts(volumeName)
+	if err != nil {
+		log.Errorf("Failed to read active mounts of volume %s: %v", volumeName, err)
+		return nil, internalError("failed to read active mounts", err)
+	}
+	upperSize, err := dirSize(d.currentUpperdir(volumeName))
+	if err != nil {
+		log.Errorf("Failed to compute the upperdir size of volume %s: %v", volumeName, err)
+		return nil, internalError("failed to compute the size of the volume's changes", err)
+	}
+
+	mountpoint := d.mountpointdir(volumeName)
+	if vol.Private {
+		mountpoint = "" // See `DockerOnTop.Path`
+	}
+	status := &volume.Volume{
+		Name:       volumeName,
+		Mountpoint: mountpoint,
+		CreatedAt:  createdAt.Format(time.RFC3339),
+		Status: map[string]interface{}{
+			"Base":         joinBaseDirs(vol.BaseDirPaths),
+			"Volatile":     vol.Volatile,
+			"Mounted":      mounted,
+			"ActiveMounts": activeMounts,
+			"UpperSize":    upperSize,
+		},
+	}
+	if vol.BaseVolume != "" {
+		status.Status["BaseVolume"] = vol.BaseVolume
+	}
+	if vol.Volatile {
+		status.Status["VolatileMode"] = vol.VolatileMode
+	}
+	if len(vol.MountFlags) > 0 {
+		status.Status["MountFlags"] = vol.MountFlags
+	}
+	if len(vol.OverlayOptions) > 0 {
+		status.Status["OverlayOptions"] = vol.OverlayOptions
+	}
+	if vol.Private {
+		status.Status["Sharing"] = "private"
+		ids, err := d.privateMountIds(volumeName)
+		if err != nil {
+			log.Errorf("Failed to list the private mounts of volume %s: %v", volumeName, err)
+			return nil, internalError("failed to list the private mounts", err)
+		}
+		privateMountpoints := make(map[string]string, len(ids))
+		for _, id := range ids {
+			privateMountpoints[id] = d.privateMountpoint(volumeName, id)
+		}
+		status.Status["PrivateMountpoints"] = privateMountpoints
+	}
+	if vol.UpperTmpfs {
+		status.Status["Upper"] = "tmpfs"
+		if vol.TmpfsSize != "" {
+			status.Status["TmpfsSize"] = vol.TmpfsSize
+		}
+	}
+	if vol.Quota > 0 && vol.QuotaMode == quotaModeProject {
+		status.Status["Quota"] = vol.Quota
+		status.Status["QuotaMode"] = vol.QuotaMode
+		if vol.QuotaInodes > 0 {
+			status.Status["QuotaInodes"] = vol.QuotaInodes
+		}
+		if used, inodesUsed, err := d.projectQuotaUsage(volumeName, vol.ProjectID); err == nil {
+			status.Status["QuotaUsed"] = used
+			status.Status["QuotaInodesUsed"] = inodesUsed
+		}
+	} else if vol.Quota > 0 {
+		status.Status["Quota"] = vol.Quota
+		if used, _, err := d.quotaUsage(volumeName); err == nil {
+			status.Status["QuotaUsed"] = used
+		}
+	}
+	if vol.Pool != "" {
+		status.Status["Pool"] = vol.Pool
+	}
+	if vol.Exclusive {
+		status.Status["Exclusive"] = true
+	}
+	if vol.History > 0 {
+		status.Status["History"] = vol.History
+	}
+	if vol.Trash > 0 {
+		status.Status["Trash"] = vol.Trash
+	}
+	if vol.TrashMaxAge > 0 {
+		status.Status["TrashMaxAge"] = vol.TrashMaxAge.String()
+	}
+	return status, nil
+}
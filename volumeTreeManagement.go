@@ -2,7 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"syscall"
 )
 
 /*
@@ -16,52 +19,143 @@ when the volume is removed.
 
 Inside a volume's main directory there are the following files/directories:
 	- metadata.json  - stores the volume's metadata, which comprises the options it was created with. Exists always.
+		It is rewritten via a temporary metadata.json.new (see `writeVolumeInfo`).
 	- activemounts/  - stores information about containers currently using the volume. Exists always. Each file in it
 		uniquely corresponds to a container.
 		On mount/unmount operations, an exclusive lock (via `flock`) is taken on this directory until all the
 		mount/unmount-related actions are completed.
 	- upper/  - the upperdir of an overlay mount. Exists always. For volatile mounts, recreated from scratch on every
 		mount (unless the volume is already mounted to another container). On unmount no special action occurs.
-	- workdir/  - the workdir of an overlay mount. Exists only when the volume is mounted.
+	- workdir/  - the workdir of an overlay mount. Exists only when the volume is mounted (or if the plugin crashed
+		while it was mounted).
 	- mountpoint/  - the directory where the overlay is to be mounted to. Exists only when the volume is mounted.
+	- snapshots/  - stores the snapshots of the volume's changes (see snapshot.go), a directory per snapshot. Each
+		snapshot directory contains a copy of upper/ and snapshot.json with the snapshot's metadata. Exists only if a
+		snapshot has ever been taken.
+	- history/  - stores the history generations of the volume (see history.go), laid out just like snapshots/.
+		Exists only for volumes with the `history` option.
+	- trash/  - stores the discarded changes of a volatile volume (see trash.go), laid out just like snapshots/.
+		Exists only for volumes with the `trash` or `trashmaxage` option.
+	- private/  - for private volumes (see privateMount.go), a directory per container using the volume (named as its
+		file in activemounts/), containing the container's own upper/, workdir/ and mountpoint/. Exists only while
+		the volume is in use.
+	- tmpfs/  - for volumes with the `upper=tmpfs` option, the mountpoint of the tmpfs that holds the overlay's upper/
+		and workdir/ instead of the ones above (see `volumeTreeMountTmpfs`). Exists only when the volume is mounted.
+	- upper.img  - for volumes with the `quota` option, the ext4 image that holds the changes (see quota.go).
+	- quota/  - the mountpoint of upper.img. When the volume has a quota, upper/, workdir/, upper.new/ and upper.old/
+		are inside it instead of the main directory.
+	- historypending  - a file that tells that the volume's changes are yet to be saved to history/ (see
+		`historySaveLater`). Normally, it only exists for a moment after the volume is unmounted.
+	- keepupper  - a file that prevents the changes restored from the trash from being discarded on the next mount
+		(see `trashRestore`). Normally, it doesn't exist.
+	- upper.new/, upper.old/  - temporary directories used while upper/ is being replaced (see
+		`volumeTreeReplaceUpper`). Normally, they don't exist.
+	- commit/  - a temporary directory used while the changes are committed to the base (see `applyChanges`).
+		Normally, it doesn't exist.
+	- probe/  - a temporary directory with the throwaway overlay directories of `probeMount`. Normally, it doesn't
+		exist.
+	- storage  - for volumes in a storage pool (see `Config.Pools`), a symlink to the volume's directory in the pool,
+		which holds upper/, workdir/, upper.img, snapshots/, history/, trash/, private/, commit/, probe/, upper.new/
+		and upper.old/ instead of the main directory. The rest, including metadata.json and activemounts/, is always in
+		the main directory.
 */
 
 func (d *DockerOnTop) activemountsdir(volumeName string) string {
 	return d.dotRootDir + volumeName + "/activemounts/"
 }
 
+// storagedir returns the directory that holds the volume's upper/ and workdir/ (unless the volume has a quota, see
+// `upperrootdir`), as well as its other bulky data: the storage symlink to the volume's directory in its pool, if the
+// volume is in one, or the main directory otherwise.
+func (d *DockerOnTop) storagedir(volumeName string) string {
+	if _, err := os.Lstat(d.dotRootDir + volumeName + "/storage"); err == nil {
+		return d.dotRootDir + volumeName + "/storage/"
+	}
+	return d.dotRootDir + volumeName + "/"
+}
+
 func (d *DockerOnTop) upperdir(volumeName string) string {
-	return d.dotRootDir + volumeName + "/upper/"
+	return d.upperrootdir(volumeName) + "upper/"
 }
 
 func (d *DockerOnTop) workdir(volumeName string) string {
-	return d.dotRootDir + volumeName + "/workdir/"
+	return d.upperrootdir(volumeName) + "workdir/"
 }
 
 func (d *DockerOnTop) mountpointdir(volumeName string) string {
 	return d.dotRootDir + volumeName + "/mountpoint/"
 }
 
+func (d *DockerOnTop) tmpfsdir(volumeName string) string {
+	return d.dotRootDir + volumeName + "/tmpfs/"
+}
+
+// overlayDirs returns the upperdir and the workdir to mount the volume's overlay with.
+func (d *DockerOnTop) overlayDirs(volumeName string, vol VolumeInfo) (string, string) {
+	if vol.UpperTmpfs {
+		return d.tmpfsdir(volumeName) + "upper/", d.tmpfsdir(volumeName) + "workdir/"
+	}
+	return d.upperdir(volumeName), d.workdir(volumeName)
+}
+
+// currentUpperdir returns the directory that holds the volume's changes at the moment: the upperdir on the tmpfs while
+// it is mounted (for volumes with the `upper=tmpfs` option), or the usual upperdir otherwise.
+func (d *DockerOnTop) currentUpperdir(volumeName string) string {
+	if mounted, err := isMountpoint(d.tmpfsdir(volumeName)); err == nil && mounted {
+		return d.tmpfsdir(volumeName) + "upper/"
+	}
+	return d.upperdir(volumeName)
+}
+
 // volumeTreeOnBootReset resets the volume's tree, which is useful in case the plugin was restarted or the system
 // rebooted without proper volume cleanup.
 //
-// The function first attempts to remove mountpoint/, then recreates the activemounts/ directory (all previous active
-// mounts are discarded), then recursively removes the workdir/ directory.
+// The volume's quota image, if any, must be mounted beforehand (see `volumeTreeMountQuota`). The function performs
+// the following steps:
+//  1. Attempts to remove mountpoint/.
+//  2. Removes the private mounts' directories (see `DockerOnTop.privateMountsOnBootReset`).
+//  3. Unmounts the tmpfs, if any (see `volumeTreeUnmountTmpfs`).
+//  4. Cleans up after an overlay mounted with the "volatile" option (see `volumeTreeDiscardDirty`).
+//  5. Recreates the activemounts/ directory (all previous active mounts are discarded).
+//  6. Recursively removes the workdir/ directory.
 //
 // If an error occurs in any of the steps, the next steps are not performed and the error is returned (but not logged).
-// An error satisfying `os.IsNotExist(err)` is an exception: it is only respected in the first step
-// (that is, if mountpoint/ does not exist, no further actions are performed and a corresponding error is returned) but
-// on the rest of the steps this error is suppressed (e.g. the absence of activemounts/ or workdir/ is not considered an
-// error and is not reported).
+// An error satisfying `os.IsNotExist(err)` is an exception: it is only respected in step 1. That is, if mountpoint/
+// does not exist, only steps 2-4 are performed and a corresponding error is returned, unless there were private
+// mounts' directories or a tmpfs. On the rest of the steps this error is suppressed (e.g. the absence of activemounts/
+// or workdir/ is not considered an error and is not reported).
 //
 // Note that in case an overlay is mounted for the volume (e.g. if the plugin is restarted without a machine reboot),
-// the first operation fails with `syscall.EBUSY` and further actions are not performed, so the volume state remains
-// valid.
+// the first step fails with `syscall.EBUSY` and further actions are not performed, so the volume state remains valid.
 func (d *DockerOnTop) volumeTreeOnBootReset(volumeName string) error {
 	// For the strict compliance with the doc, I check for `os.IsNotExist(err)` for all errors, even though for some
 	// operations this error is either impossible (`os.RemoveAll`) or extremely unlikely in our case (`os.Mkdir`)
 
 	err := os.Remove(d.mountpointdir(volumeName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Private volumes (see privateMount.go) never have the shared mountpoint, so their private directories are checked
+	// regardless of it
+	privateDirty, privateErr := d.privateMountsOnBootReset(volumeName)
+	if privateErr != nil {
+		return privateErr
+	} else if privateDirty && os.IsNotExist(err) {
+		err = nil // The volume's state was dirty nonetheless, so the cleanup shall continue
+	}
+	// The tmpfs is not in use by the overlay now, so it is not needed anymore
+	if _, tmpfsErr := os.Stat(d.tmpfsdir(volumeName)); tmpfsErr == nil {
+		if tmpfsErr = d.volumeTreeUnmountTmpfs(volumeName, 0); tmpfsErr != nil {
+			return tmpfsErr
+		} else if os.IsNotExist(err) {
+			err = nil // Same as above
+		}
+	}
+	// The overlay is not mounted now. If it was mounted with the "volatile" option and was not unmounted properly
+	// (which is not necessarily detectable by the mountpoint's presence), it needs a cleanup
+	if dirtyErr := d.volumeTreeDiscardDirty(volumeName); dirtyErr != nil {
+		return dirtyErr
+	}
 	if err != nil {
 		return err
 	}
@@ -82,12 +176,54 @@ func (d *DockerOnTop) volumeTreeOnBootReset(volumeName string) error {
 	return nil
 }
 
-// volumeTreeCreate creates a directory tree for the specified volume (but not metadata.json).
+// volatileMarker is the directory that overlayfs creates inside the workdir when the overlay is mounted with the
+// "volatile" option. While it exists, the overlay cannot be mounted again: the changes might have not been synced to
+// the upperdir before a crash.
+func (d *DockerOnTop) volatileMarker(volumeName string) string {
+	return d.workdir(volumeName) + "work/incompat/volatile"
+}
+
+// volumeTreeDiscardDirty checks if the volume's workdir has the volatile marker (see `volatileMarker`) and, if it
+// does, removes the workdir and discards the changes in the upperdir, which might be corrupt. The overlay must not be
+// mounted.
+//
+// Under normal operation, the marker is removed together with the workdir in `volumeTreePostUnmount`, so it is only
+// left if the plugin or the system crashed while the overlay was mounted.
+//
+// Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeDiscardDirty(volumeName string) error {
+	_, err := os.Stat(d.volatileMarker(volumeName))
+	if os.IsNotExist(err) || isNotDirError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Warningf("Volume %s was mounted with overlayfs's \"volatile\" option and not unmounted properly. "+
+		"Discarding its changes", volumeName)
+	if err = os.RemoveAll(d.workdir(volumeName)); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(d.upperdir(volumeName)); err != nil {
+		return err
+	}
+	if err = os.Mkdir(d.upperdir(volumeName), os.ModePerm); err != nil {
+		return err
+	}
+	if err = d.volumeTreeCopyBaseRoot(volumeName, d.upperdir(volumeName)); err != nil {
+		// Not worth failing for: this happens on boot, when the base might be unavailable yet
+		log.Warningf("Failed to copy the attributes of the base's root to the upperdir of %s: %v", volumeName, err)
+	}
+	return nil
+}
+
+// volumeTreeCreate creates a directory tree for the specified volume (but not metadata.json). If `poolDir` is not
+// empty, the volume's storage directory is created in it (see `storagedir`).
 //
 // If errors occur, they are logged and the returned error is wrapped with `internalError`, except when volume already
 // exists. In that case, nothing is logged and an error such that `os.IsExist(err)` is returned (without additional
 // wrapping).
-func (d *DockerOnTop) volumeTreeCreate(volumeName string) error {
+func (d *DockerOnTop) volumeTreeCreate(volumeName string, poolDir string) error {
 	if err := os.Mkdir(d.dotRootDir+volumeName, os.ModePerm); err != nil {
 		if os.IsExist(err) {
 			return err
@@ -97,6 +233,23 @@ func (d *DockerOnTop) volumeTreeCreate(volumeName string) error {
 		}
 	}
 
+	if poolDir != "" {
+		// A leftover directory of a volume with the same name is not reused: it is not known what is inside
+		err := os.Mkdir(poolDir+volumeName, os.ModePerm)
+		if err == nil {
+			err = os.Symlink(poolDir+volumeName, d.dotRootDir+volumeName+"/storage")
+			if err != nil {
+				_ = os.Remove(poolDir + volumeName)
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to create the storage directory of %s in %s: %v. Aborting volume creation "+
+				"(attempting to destroy the volume's tree)", volumeName, poolDir, err)
+			_ = d.volumeTreeDestroy(volumeName) // The errors are logged, if any
+			return internalError("failed to create the volume's directory in the pool", err)
+		}
+	}
+
 	// Try to create internal directories. On failure, revert the creation of the volume main directory
 	for _, dir := range []string{d.upperdir(volumeName), d.activemountsdir(volumeName)} {
 		if err := os.Mkdir(dir, os.ModePerm); err != nil {
@@ -116,6 +269,24 @@ func (d *DockerOnTop) volumeTreeCreate(volumeName string) error {
 // If errors occur, they are logged and the returned error is wrapped with `internalError`.
 // Note that if the volume doesn't exist, the function call is considered successful (`nil` is returned).
 func (d *DockerOnTop) volumeTreeDestroy(volumeName string) error {
+	// A tmpfs might be left mounted if the plugin crashed while the volume was mounted. Detaching it, as it might still
+	// be used by a leftover overlay (see the conceptual note in driver.go)
+	if err := d.volumeTreeUnmountTmpfs(volumeName, syscall.MNT_DETACH); err != nil {
+		log.Errorf("Failed to unmount the tmpfs: %v", err)
+		return internalError("failed to unmount the tmpfs", err)
+	}
+	// Otherwise, the contents of the quota image would be removed one by one, and then the removal would fail anyway
+	if err := d.volumeTreeUnmountQuota(volumeName); err != nil {
+		log.Errorf("Failed to unmount the quota image: %v", err)
+		return internalError("failed to unmount the quota image", err)
+	}
+	// The storage symlink itself is removed together with the main directory, but not what it points to
+	if storage, err := os.Readlink(d.dotRootDir + volumeName + "/storage"); err == nil {
+		if err = os.RemoveAll(storage); err != nil {
+			log.Errorf("Failed to RemoveAll storage directory: %v", err)
+			return internalError("failed to RemoveAll volume storage directory", err)
+		}
+	}
 	err := os.RemoveAll(d.dotRootDir + volumeName)
 	if err != nil {
 		log.Errorf("Failed to RemoveAll main directory: %v", err)
@@ -135,6 +306,22 @@ func (d *DockerOnTop) volumeTreePreMount(volumeName string, discardUpper bool) e
 	mountpoint := d.mountpointdir(volumeName)
 	workdir := d.workdir(volumeName)
 
+	// The error is logged below, if any. Note: `volumeTreeDiscardDirty` and the mkdirs need the image mounted
+	quotaErr := d.volumeTreeMountQuota(volumeName)
+	if quotaErr != nil {
+		log.Errorf("Failed to mount the quota image of %s: %v", volumeName, quotaErr)
+		return internalError("failed to mount the quota image", quotaErr)
+	}
+
+	// If the overlay was mounted with the "volatile" option and was not unmounted properly, it cannot be mounted again
+	// until cleaned up. Unless it is still mounted, in which case the workdir is in use
+	if mounted, err := isMountpoint(mountpoint); err == nil && !mounted {
+		if err = d.volumeTreeDiscardDirty(volumeName); err != nil {
+			log.Errorf("Failed to clean up after the previous volatile mount of %s: %v", volumeName, err)
+			return internalError("failed to clean up after the previous volatile mount", err)
+		}
+	}
+
 	err1 := os.Mkdir(mountpoint, os.ModePerm)
 	if os.IsExist(err1) {
 		log.Warningf("Mountpoint of %s already exists. It might mean that the overlay is already mounted "+
@@ -168,23 +355,234 @@ func (d *DockerOnTop) volumeTreePreMount(volumeName string, discardUpper bool) e
 
 		return internalError("failed to prepare internal directories", err)
 	}
+	// Overlayfs prepares the files in the workdir and then renames them into the upperdir, which fails if they get
+	// different project IDs (see projectQuota.go)
+	if err = d.volumeTreeInitUpper(volumeName, workdir); err != nil {
+		log.Errorf("Failed to initialize workdir of %s: %v", volumeName, err)
+		return internalError("failed to prepare internal directories", err)
+	}
+
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to retrieve the volume's metadata", err)
+	}
+	if vol.UpperTmpfs {
+		// The error is already logged and wrapped in `internalError` by `d.volumeTreeMountTmpfs`
+		if err = d.volumeTreeMountTmpfs(volumeName, vol.TmpfsSize); err != nil {
+			return err
+		}
+	}
 
-	// For volatile volume, discard previous changes
+	// The changes restored from the trash are to be seen by this mount (see `trashRestore`)
+	err = os.Remove(d.keepuppermarker(volumeName))
+	if err == nil && discardUpper {
+		log.Debugf("The changes of %s have been restored from the trash. Not discarding them", volumeName)
+		discardUpper = false
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove the keep-upper marker of %s: %v", volumeName, err)
+		return internalError("failed to check if the changes are to be kept", err)
+	}
+
+	// For volatile volume, discard previous changes. Unless a volume stacked on this one is mounted: its lower layer
+	// must not be modified. The changes are then kept until the next mount
 	if discardUpper {
-		upperdir := d.upperdir(volumeName)
+		release, err := d.lockIdleDependents(volumeName, d.upperdir(volumeName))
+		if err != nil {
+			log.Warningf("Not discarding the changes of %s: %v", volumeName, err)
+			return nil
+		}
+		defer release()
+		// The error is already logged and wrapped in `internalError` by `d.volumeTreeDiscardUpper`
+		return d.volumeTreeDiscardUpper(volumeName)
+	}
+
+	return nil
+}
+
+// volumeTreeResetUpper discards all the changes made to the volume by recreating its upperdir.
+//
+// The volume must not be mounted: overlayfs does not allow to modify the upperdir of a mounted overlay.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeResetUpper(volumeName string) error {
+	upperdir := d.upperdir(volumeName)
+
+	err := os.RemoveAll(upperdir)
+	if err != nil {
+		log.Errorf("Failed to RemoveAll upperdir: %v", err)
+		return internalError("failed to discard previous changes", err)
+	}
+	err = os.Mkdir(upperdir, os.ModePerm)
+	if err != nil {
+		log.Errorf("Failed to Mkdir upperdir: %v", err)
+		return internalError("failed to create upperdir after discarding changes", err)
+	}
+	err = d.volumeTreeCopyBaseRoot(volumeName, upperdir)
+	if err == nil {
+		err = d.volumeTreeInitUpper(volumeName, upperdir)
+	}
+	if err != nil {
+		log.Errorf("Failed to initialize upperdir: %v", err)
+		return internalError("failed to initialize upperdir after discarding changes", err)
+	}
+
+	return nil
+}
 
-		err = os.RemoveAll(upperdir)
+// volumeTreeCopyBaseRoot gives the new (empty) upperdir at `upperdir` the ownership, mode and xattrs of the root of
+// the volume's topmost lower layer. Overlayfs takes the attributes of the overlay's root from the upperdir, so
+// otherwise the volume's root would be owned by root with mode 0777 (minus umask), whatever the base's root is, which
+// breaks the containers running as other users. Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeCopyBaseRoot(volumeName string, upperdir string) error {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	}
+	lowers, err := d.volumeLowerDirs(volumeName)
+	if err != nil {
+		return err
+	}
+	return copyRootAttributes(lowers[0], upperdir, overlayXattrPrefix(vol.OverlayOptions))
+}
+
+// volumeTreeInitUpper prepares a newly created upperdir (or a copy of one) at `upperdir` to become the volume's
+// upperdir: sets the volume's project ID on it, if the volume has a project quota (see projectQuota.go). The same is
+// needed for a new workdir. Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeInitUpper(volumeName string, upperdir string) error {
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	}
+	if vol.ProjectID != 0 {
+		return setProjectID(upperdir, vol.ProjectID)
+	}
+	return nil
+}
+
+// volumeTreeReplaceUpper replaces the volume's upperdir with a copy of the directory `src` (which must be a valid
+// upperdir, e.g., a snapshot of one).
+//
+// The copy is prepared aside first, so if the copying fails, the upperdir is left intact.
+//
+// The volume must not be mounted: overlayfs does not allow to modify the upperdir of a mounted overlay.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeReplaceUpper(volumeName string, src string) error {
+	upperdir := strings.TrimSuffix(d.upperdir(volumeName), "/")
+	newUpper, oldUpper := upperdir+".new", upperdir+".old"
+
+	// Either might be left over from an interrupted attempt
+	err := errors.Join(os.RemoveAll(newUpper), os.RemoveAll(oldUpper))
+	if err == nil {
+		err = copyTree(src, newUpper)
+	}
+	if err == nil {
+		err = d.volumeTreeInitUpper(volumeName, newUpper)
+	}
+	if err != nil {
+		log.Errorf("Failed to prepare the new upperdir for %s: %v", volumeName, err)
+		_ = os.RemoveAll(newUpper)
+		return internalError("failed to copy the new changes", err)
+	}
+
+	err = os.Rename(upperdir, oldUpper)
+	if err == nil {
+		err = os.Rename(newUpper, upperdir)
+		if err != nil {
+			_ = os.Rename(oldUpper, upperdir) // Try to put it back, so that the volume remains usable
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to swap the upperdir of %s: %v", volumeName, err)
+		_ = os.RemoveAll(newUpper)
+		return internalError("failed to replace the upperdir", err)
+	}
+
+	if err = os.RemoveAll(oldUpper); err != nil {
+		// The volume is fine, only the disk space is wasted
+		log.Warningf("Failed to RemoveAll the old upperdir of %s: %v", volumeName, err)
+	}
+	return nil
+}
+
+// volumeTreeCloneUpper replaces the volume's upperdir with a copy of the upperdir of the volume `sourceName`, so
+// that the volume has the same changes as the source one.
+//
+// The source volume may be in use, but then its files are copied in whatever state they are at the moment. The lock
+// on the source's activemounts/ is held during the copying, so it is not mounted or unmounted in the process. The
+// volume itself must not be mounted.
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeCloneUpper(volumeName string, sourceName string) error {
+	var activemountsdir lockedFile
+	err := activemountsdir.Open(d.activemountsdir(sourceName))
+	if err != nil {
+		// The error is already logged and wrapped in `internalError` in lockedFile.go
+		return err
+	}
+	defer activemountsdir.Close() // There's nothing I can do about the error if it occurs
+
+	// The error is already logged and wrapped in `internalError` by `d.volumeTreeReplaceUpper`
+	return d.volumeTreeReplaceUpper(volumeName, d.upperdir(sourceName))
+}
+
+// volumeTreeResetPath discards the changes made to the file or directory at `relPath` (relative to the volume's root,
+// starting with a slash) by removing it from the volume's upperdir, so that the base version of it is seen in the
+// volume again (or nothing, if it does not exist in the base). For a directory, the changes inside it are discarded
+// as well.
+//
+// If an ancestor of the path replaces the base directory (it is opaque) or is renamed, the base version of the path
+// cannot be uncovered, so an error is returned (the ancestor should be reset instead).
+//
+// The volume must not be mounted: overlayfs does not allow to modify the upperdir of a mounted overlay.
+//
+// Errors are logged, and the ones that are not the user's fault are wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeResetPath(volumeName string, relPath string) error {
+	upperdir := strings.TrimSuffix(d.upperdir(volumeName), "/")
+	vol, err := d.getVolumeInfo(volumeName)
+	if err != nil {
+		log.Errorf("Failed to retrieve metadata for volume %s: %v", volumeName, err)
+		return internalError("failed to retrieve the volume's metadata", err)
+	}
+	prefix := overlayXattrPrefix(vol.OverlayOptions)
+
+	for i := 1; i < len(relPath); i++ {
+		if relPath[i] != '/' {
+			continue
+		}
+		ancestor := upperdir + relPath[:i]
+		info, err := os.Lstat(ancestor)
+		if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+			log.Debugf("%s is not changed in volume %s. Nothing to reset", relPath, volumeName)
+			return nil
+		} else if err != nil {
+			log.Errorf("Failed to Lstat %s: %v", ancestor, err)
+			return internalError("failed to inspect the upperdir", err)
+		}
+
+		opaque, err := isOpaqueDir(ancestor, info, prefix)
 		if err != nil {
-			log.Errorf("Failed to RemoveAll upperdir (for volatile): %v", err)
-			return internalError("failed to discard previous changes", err)
+			log.Errorf("Failed to check if %s is opaque: %v", ancestor, err)
+			return internalError("failed to inspect the upperdir", err)
 		}
-		err = os.Mkdir(upperdir, os.ModePerm)
+		redirect, err := getOverlayXattr(ancestor, info, prefix, "redirect")
 		if err != nil {
-			log.Errorf("Failed to Mkdir upperdir (for volatile): %v", err)
-			return internalError("failed to create upperdir after discarding changes", err)
+			log.Errorf("Failed to check if %s is renamed: %v", ancestor, err)
+			return internalError("failed to inspect the upperdir", err)
+		}
+		if opaque || redirect != nil {
+			log.Debugf("Ancestor %s of %s is opaque or renamed. Cannot reset", relPath[:i], relPath)
+			return fmt.Errorf("%s replaces or renames a base directory, so %s cannot be reset separately; "+
+				"reset %s instead", relPath[:i], relPath, relPath[:i])
 		}
 	}
 
+	err = os.RemoveAll(upperdir + relPath)
+	if err != nil {
+		log.Errorf("Failed to RemoveAll %s from upperdir of %s: %v", relPath, volumeName, err)
+		return internalError("failed to discard the changes", err)
+	}
 	return nil
 }
 
@@ -198,6 +596,9 @@ func (d *DockerOnTop) volumeTreePreMount(volumeName string, discardUpper bool) e
 // combined with `errors.Join` and returned (wrapped with `internalError`).
 //
 // Note: for technical reasons, the absence of the workdir directory is not considered an error.
+//
+// If the volume's upperdir and workdir are on a tmpfs (see `volumeTreeMountTmpfs`), the tmpfs is unmounted as well,
+// which discards the changes.
 func (d *DockerOnTop) volumeTreePostUnmount(volumeName string) error {
 	err1 := os.Remove(d.mountpointdir(volumeName))
 	err2 := os.RemoveAll(d.workdir(volumeName))
@@ -206,5 +607,69 @@ func (d *DockerOnTop) volumeTreePostUnmount(volumeName string) error {
 		log.Errorf("Cleanup of %s failed. Errors for mountpoint, workdir: %v, %v", volumeName, err1, err2)
 		return internalError("failed to cleanup on unmount", err)
 	}
+	if err = d.volumeTreeUnmountTmpfs(volumeName, 0); err != nil {
+		log.Errorf("Failed to unmount the tmpfs of %s: %v", volumeName, err)
+		return internalError("failed to unmount the tmpfs on unmount", err)
+	}
 	return nil
 }
+
+// volumeTreeMountTmpfs mounts a tmpfs (limited to `size`, in the format of tmpfs's "size" option, unless empty) at the
+// volume's tmpfs/ and creates the upperdir and the workdir for the overlay on it, so the changes are stored in RAM.
+// A tmpfs left mounted from before (e.g., if the plugin crashed) is detached first (it might still be used by a
+// leftover overlay, see the conceptual note in driver.go).
+//
+// If errors occur, they are logged and the returned error is wrapped with `internalError`.
+func (d *DockerOnTop) volumeTreeMountTmpfs(volumeName string, size string) error {
+	if err := d.volumeTreeUnmountTmpfs(volumeName, syscall.MNT_DETACH); err != nil {
+		log.Errorf("Failed to unmount the leftover tmpfs of %s: %v", volumeName, err)
+		return internalError("failed to unmount the leftover tmpfs", err)
+	}
+
+	tmpfsdir := d.tmpfsdir(volumeName)
+	data := "mode=0755"
+	if size != "" {
+		data += ",size=" + size
+	}
+	err := os.Mkdir(tmpfsdir, os.ModePerm)
+	if err == nil {
+		err = syscall.Mount("docker-on-top_"+volumeName, tmpfsdir, "tmpfs", 0, data)
+		if err != nil {
+			err = &os.PathError{Op: "mount", Path: tmpfsdir, Err: err}
+			_ = os.Remove(tmpfsdir)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to mount tmpfs for volume %s: %v", volumeName, err)
+		return internalError("failed to mount tmpfs for the changes", err)
+	}
+
+	err = errors.Join(os.Mkdir(tmpfsdir+"upper", os.ModePerm), os.Mkdir(tmpfsdir+"workdir", os.ModePerm))
+	if err == nil {
+		err = d.volumeTreeCopyBaseRoot(volumeName, tmpfsdir+"upper")
+	}
+	if err != nil {
+		log.Errorf("Failed to Mkdir upperdir, workdir on the tmpfs of %s: %v", volumeName, err)
+		_ = d.volumeTreeUnmountTmpfs(volumeName, 0)
+		return internalError("failed to prepare internal directories", err)
+	}
+	return nil
+}
+
+// volumeTreeUnmountTmpfs unmounts the volume's tmpfs (see `volumeTreeMountTmpfs`) with `unmountFlags`, if it is
+// mounted, and removes the tmpfs/ directory, if it exists. Unless `unmountFlags` has `syscall.MNT_DETACH`, the
+// overlay must not be mounted. Errors are returned but not logged.
+func (d *DockerOnTop) volumeTreeUnmountTmpfs(volumeName string, unmountFlags int) error {
+	tmpfsdir := d.tmpfsdir(volumeName)
+	mounted, err := isMountpoint(tmpfsdir)
+	if err == nil && mounted {
+		err = syscall.Unmount(tmpfsdir, unmountFlags)
+		if err != nil {
+			err = &os.PathError{Op: "unmount", Path: tmpfsdir, Err: err}
+		}
+	}
+	if err == nil {
+		err = os.RemoveAll(tmpfsdir)
+	}
+	return err
+}